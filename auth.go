@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var hostname string
+var childargs []string
+
+func (s *Session) err_authd()    { s.reply_out(reply(503, "5.5.0", "you're already authenticated")) }
+func (s *Session) err_authmail() { s.reply_out(reply(503, "5.5.0", "no auth during mail transaction")) }
+func (s *Session) err_authfail() { s.reply_out(reply(535, "5.7.8", "authorization failed")) }
+func (s *Session) err_authabrt() { s.reply_out(reply(501, "5.0.0", "auth exchange cancelled")) }
+func (s *Session) err_input()    { s.reply_out(reply(501, "5.5.4", "malformed auth input")) }
+func (s *Session) err_child() {
+	s.reply_out(reply(454, "4.3.0", "oops, problem with child and I can't auth"))
+}
+func (s *Session) err_authtls() {
+	s.reply_out(reply(538, "5.7.11", "encryption required for requested authentication mechanism"))
+}
+
+func (s *Session) authgetl() (string, int) {
+	line, err := s.ssin.ReadString('\n')
+	if err != nil {
+		s.die_read()
+	}
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	if line == "*" {
+		s.err_authabrt()
+		return "", 0
+	}
+	return line, 1
+}
+
+func (s *Session) b64decode(str string) (string, int) {
+	b, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		s.err_input()
+		return "", 0
+	}
+	return string(b), 1
+}
+
+/* checkpassword interface: user\0pass\0resp\0 on fd 3 */
+
+func authenticate(user, pass, resp string) int {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return -1
+	}
+	defer pr.Close()
+
+	cmd := exec.Command(childargs[0], childargs[1:]...)
+	cmd.ExtraFiles = []*os.File{pr}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return -1
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(user)
+	buf.WriteByte(0)
+	buf.WriteString(pass)
+	buf.WriteByte(0)
+	buf.WriteString(resp)
+	buf.WriteByte(0)
+	_, werr := pw.Write(buf.Bytes())
+	pw.Close()
+
+	if err := cmd.Wait(); err != nil {
+		if !cmd.ProcessState.Exited() {
+			return -1 /* crashed */
+		}
+		return 1
+	}
+	if werr != nil {
+		return -1
+	}
+	return 0
+}
+
+func (s *Session) auth_login(arg string) (user, pass, resp string, r int) {
+	if arg != "" {
+		if user, r = s.b64decode(arg); r == 0 {
+			return
+		}
+	} else {
+		s.reply_out(reply(334, "", "VXNlcm5hbWU6")) /* Username: */
+		s.flush()
+		var line string
+		if line, r = s.authgetl(); r == 0 {
+			return
+		}
+		if user, r = s.b64decode(line); r == 0 {
+			return
+		}
+	}
+
+	s.reply_out(reply(334, "", "UGFzc3dvcmQ6")) /* Password: */
+	s.flush()
+	var line string
+	if line, r = s.authgetl(); r == 0 {
+		return
+	}
+	if pass, r = s.b64decode(line); r == 0 {
+		return
+	}
+
+	if user == "" || pass == "" {
+		s.err_input()
+		return "", "", "", 0
+	}
+	return user, pass, "", 1
+}
+
+func (s *Session) auth_plain(arg string) (user, pass, resp string, r int) {
+	if arg == "" {
+		s.reply_out(reply(334, "", ""))
+		s.flush()
+		if arg, r = s.authgetl(); r == 0 {
+			return
+		}
+	}
+
+	var plain string
+	if plain, r = s.b64decode(arg); r == 0 {
+		return
+	}
+
+	/* authorize-id\0userid\0passwd */
+	f := strings.Split(plain, "\x00")
+	if len(f) != 3 || f[1] == "" || f[2] == "" {
+		s.err_input()
+		return "", "", "", 0
+	}
+	return f[1], f[2], "", 1
+}
+
+func (s *Session) auth_cram(arg string) (user, pass, resp string, r int) {
+	if arg != "" {
+		s.err_input()
+		return "", "", "", 0
+	}
+
+	/* the pid is the same for every session in -listen mode */
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		s.reply_out(reply(454, "4.3.0", "unable to make a challenge"))
+		return "", "", "", 0
+	}
+	challenge := "<" + strconv.Itoa(os.Getpid()) + "." + hex.EncodeToString(nonce[:]) + "." +
+		strconv.FormatInt(time.Now().Unix(), 10) + "@" + hostname + ">"
+	s.reply_out(reply(334, "", base64.StdEncoding.EncodeToString([]byte(challenge))))
+	s.flush()
+
+	var line string
+	if line, r = s.authgetl(); r == 0 {
+		return
+	}
+	var cram string
+	if cram, r = s.b64decode(line); r == 0 {
+		return
+	}
+
+	/* userid digest */
+	i := strings.LastIndexByte(cram, ' ')
+	if i <= 0 || i+1 == len(cram) {
+		s.err_input()
+		return "", "", "", 0
+	}
+	return cram[:i], cram[i+1:], challenge, 1
+}
+
+var authcmds = []struct {
+	text  string
+	fun   func(*Session, string) (string, string, string, int)
+	clear bool /* the password goes over the wire as it is */
+}{
+	{"plain", (*Session).auth_plain, true},
+	{"login", (*Session).auth_login, true},
+	{"cram-md5", (*Session).auth_cram, false},
+}
+
+/* no passwords in the clear while STARTTLS is on offer (rfc 4954 4) */
+func (s *Session) authclearok() bool {
+	return !servercertok || s.ssl != nil
+}
+
+/* for EHLO */
+func (s *Session) authmechs() string {
+	x := "AUTH"
+	for _, it := range authcmds {
+		if !it.clear || s.authclearok() {
+			x += " " + strings.ToUpper(it.text)
+		}
+	}
+	return x
+}
+
+func (s *Session) smtp_auth(arg string) {
+	if len(childargs) == 0 {
+		s.err_unimpl()
+		return
+	}
+	if s.authd {
+		s.err_authd()
+		return
+	}
+	if s.seenmail {
+		s.err_authmail()
+		return
+	}
+
+	mech := arg
+	arg = ""
+	if i := strings.IndexByte(mech, ' '); i != -1 {
+		arg = strings.TrimLeft(mech[i:], " ")
+		mech = mech[:i]
+	}
+
+	for _, it := range authcmds {
+		if !strings.EqualFold(it.text, mech) {
+			continue
+		}
+		if it.clear && !s.authclearok() {
+			s.err_authtls()
+			return
+		}
+		user, pass, resp, r := it.fun(s, arg)
+		if r == 0 {
+			return
+		}
+		switch authenticate(user, pass, resp) {
+		case 0:
+			s.authd = true
+			s.relayclient = ""
+			s.relayclientok = true
+			s.remoteinfo = user
+			s.reply_out(reply(235, "2.7.0", "ok, go ahead"))
+		case 1:
+			s.err_authfail()
+		default:
+			s.err_child()
+		}
+		return
+	}
+
+	s.reply_out(reply(504, "5.5.4", "auth type unimplemented"))
+}
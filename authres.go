@@ -0,0 +1,67 @@
+package main
+
+import "strings"
+
+/*
+ * Authentication-Results headers (rfc 8601) that claim to come from us.
+ *
+ * Anything downstream that trusts our authserv-id would trust a header
+ * the client wrote just as well as one we wrote, so every incoming
+ * Authentication-Results whose authserv-id is ours is dropped (rfc 8601
+ * 5; see hdrfilter.go). Results from other servers go through as they
+ * are.
+ */
+
+/* the authserv-id we put in our own headers */
+func authservid() string {
+	if !meok {
+		return hostname
+	}
+	return me
+}
+
+/*
+ * 1 if field is one of ours, 0 if it is not, -1 if more is needed to
+ * tell. final says there is no more.
+ */
+func authres_ours(field []byte, final bool) int {
+	if r := hdr_named(field, final, "authentication-results"); r != 1 {
+		return r
+	}
+	f := string(field)
+	i := strings.IndexByte(f, ':')
+
+	/* skip CFWS to the authserv-id */
+	v := f[i+1:]
+	depth := 0
+	for v != "" {
+		ch := v[0]
+		if depth == 0 && ch != '(' && ch != ' ' && ch != '\t' && ch != '\r' && ch != '\n' {
+			break
+		}
+		if ch == '(' {
+			depth++
+		} else if ch == ')' {
+			depth--
+		}
+		v = v[1:]
+	}
+	if v == "" {
+		if final {
+			return 0
+		}
+		return -1
+	}
+
+	j := strings.IndexAny(v, "; \t\r\n(")
+	if j == -1 {
+		if !final {
+			return -1
+		}
+		j = len(v)
+	}
+	if strings.EqualFold(strings.Trim(v[:j], `"`), authservid()) {
+		return 1
+	}
+	return 0
+}
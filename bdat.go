@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+ * CHUNKING (rfc 3030). Chunks go through the same \r\n to \n conversion
+ * as DATA, and no backend can store or pass on a binary body unchanged,
+ * so BINARYMIME is not offered.
+ */
+
+func (s *Session) err_bdat() { s.reply_out(reply(503, "5.5.1", "BDAT transfer in progress")) }
+
+func bdatparse(arg string) (uint, bool, int) {
+	f := strings.Fields(arg)
+	if len(f) < 1 || len(f) > 2 {
+		return 0, false, 0
+	}
+	i, u := scan_ulong(f[0])
+	if i == 0 || i != len(f[0]) || i > 18 {
+		return 0, false, 0
+	}
+	if len(f) == 1 {
+		return u, false, 1
+	}
+	if !strings.EqualFold(f[1], "LAST") {
+		return 0, false, 0
+	}
+	return u, true, 1
+}
+
+func (s *Session) bdat_discard(size uint) {
+	if _, err := io.CopyN(io.Discard, s.ssin, int64(size)); err != nil {
+		s.die_read()
+	}
+}
+
+/* chunks come with CRLF, but the queue wants LF */
+func (s *Session) bdat_copy(size uint) {
+	var buf [4096]byte
+	for size > 0 {
+		n := len(buf)
+		if uint(n) > size {
+			n = int(size)
+		}
+		n, err := s.ssin.Read(buf[:n])
+		if n == 0 && err != nil {
+			s.die_read()
+		}
+		size -= uint(n)
+
+		for _, ch := range buf[:n] {
+			hops_put(&s.bdathops, ch)
+			if s.bdatcr {
+				s.bdatcr = false
+				if ch == '\n' {
+					s.put('\n')
+					continue
+				}
+				s.put('\r')
+			}
+			if ch == '\r' {
+				s.bdatcr = true
+				continue
+			}
+			s.put(ch)
+		}
+	}
+}
+
+func (s *Session) bdat_abort() {
+	if !s.flagbdat {
+		return
+	}
+	s.flagbdat = false
+	s.dkim = nil
+	qmail_fail(&s.qqt)
+	qmail_from(&s.qqt, "")
+	qmail_close(&s.qqt)
+}
+
+func (s *Session) smtp_bdat(arg string) {
+	size, last, r := bdatparse(arg)
+	if r == 0 {
+		s.bdat_abort()
+		s.reply_out(reply(501, "5.5.4", "syntax error in BDAT"))
+		return
+	}
+
+	if !s.flagbdat {
+		if !s.seenmail {
+			s.bdat_discard(size)
+			s.err_wantmail()
+			return
+		}
+		if len(s.rcptto) == 0 {
+			s.bdat_discard(size)
+			s.err_wantrcpt()
+			return
+		}
+		s.seenmail = false
+		if databytes != 0 {
+			s.bytestooverflow = uint(databytes) + 1
+		}
+		if qmail_open(&s.qqt, s.queue_backend()) == -1 {
+			s.bdat_discard(size)
+			s.err_qqt()
+			return
+		}
+		s.flagbdat = true
+		s.bdatqp = qmail_qp(&s.qqt)
+		s.bdatcr = false
+		hops_init(&s.bdathops)
+		s.putheaders()
+	}
+
+	s.bdat_copy(size)
+
+	if !last {
+		s.reply_out(reply(250, "2.0.0", strconv.FormatUint(uint64(size), 10)+" octets received"))
+		return
+	}
+
+	s.flagbdat = false
+	if s.bdatcr {
+		s.put('\r')
+	}
+	s.finishmessage(s.bdathops.hops, s.bdatqp)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"time"
+)
+
+/*
+ * Bounces for backends that learn only after the message that it got to
+ * some recipients and not to others. The client has been told 250 (see
+ * queue_reply), so the sender hears about the others from us, as from
+ * qmail-send: the bounce goes in through bin/qmail-queue with an empty
+ * sender, and has a copy of the message. Temporary failures are given
+ * up on at once; there is nowhere to keep the message for another try.
+ *
+ * Bounces are not bounced. If the bounce cannot be queued, all we can do
+ * is say so on stderr.
+ */
+
+/* the recipients in to that failed in qr; msg is the message */
+func queue_bounce(from string, to []string, qr tQueueResult, msg io.Reader) {
+	if from == "" || from == "#@[]" {
+		return
+	}
+
+	qb := qmailqueue_new()
+	if err := qb.Open(); err != nil {
+		log.Printf("unable to bounce to %s: %v", from, err)
+		return
+	}
+	ss := bufio.NewWriter(qb)
+	host := me
+	if !meok {
+		host = hostname
+	}
+	ss.WriteString("Date: " + time.Now().UTC().Format("2 Jan 2006 15:04:05") + " -0000\n")
+	ss.WriteString("From: MAILER-DAEMON@" + host + "\n")
+	ss.WriteString("To: " + from + "\n")
+	ss.WriteString("Subject: failure notice\n\n")
+	ss.WriteString("Hi. This is the qmail-smtpd program at " + host + ".\n")
+	ss.WriteString("I'm afraid I wasn't able to deliver your message to the following addresses.\n")
+	ss.WriteString("This is a permanent error; I've given up. Sorry it didn't work out.\n\n")
+	for i, it := range qr.rcpt {
+		if it.status != queue_ok {
+			ss.WriteString("<" + to[i] + ">:\n" + it.ecode + " " + it.text + "\n\n")
+		}
+	}
+	ss.WriteString("--- Below this line is a copy of the message.\n\n")
+	io.Copy(ss, msg)
+	if err := ss.Flush(); err != nil {
+		qb.Abort()
+		log.Printf("unable to bounce to %s: %v", from, err)
+		return
+	}
+	if err := qb.Envelope("", []string{from}, tEnvDsn{}); err != nil {
+		qb.Abort()
+		log.Printf("unable to bounce to %s: %v", from, err)
+		return
+	}
+	if qr := qb.Commit(); qr.status != queue_ok {
+		log.Printf("unable to bounce to %s: %s %s", from, qr.ecode, qr.text)
+	}
+}
@@ -0,0 +1,108 @@
+// Package cdb reads and writes constant databases in the format of
+// djb's cdb, as used by qmail for control/morercpthosts.cdb and friends.
+//
+// A cdb starts with 256 (position, slots) pairs pointing at hash tables,
+// followed by the records (klen, dlen, key, data), followed by the hash
+// tables themselves, each slot a (hash, position) pair. All numbers are
+// 32-bit little-endian.
+package cdb
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const hashstart = 5381
+
+func hashadd(h uint32, c byte) uint32 {
+	h += h << 5
+	return h ^ uint32(c)
+}
+
+// Hash is the cdb hash of key.
+func Hash(key []byte) uint32 {
+	h := uint32(hashstart)
+	for _, c := range key {
+		h = hashadd(h, c)
+	}
+	return h
+}
+
+func unpack(b []byte) uint32 { return binary.LittleEndian.Uint32(b) }
+
+func read(r io.ReaderAt, buf []byte, pos uint32) int {
+	if _, err := r.ReadAt(buf, int64(pos)); err != nil {
+		return -1
+	}
+	return 0
+}
+
+func match(r io.ReaderAt, key []byte, pos uint32) int {
+	var buf [32]byte
+	for len(key) > 0 {
+		n := len(buf)
+		if n > len(key) {
+			n = len(key)
+		}
+		if read(r, buf[:n], pos) == -1 {
+			return -1
+		}
+		if string(buf[:n]) != string(key[:n]) {
+			return 0
+		}
+		pos += uint32(n)
+		key = key[n:]
+	}
+	return 1
+}
+
+// Seek looks key up in r. It returns the data of the first record with
+// that key and 1, nil and 0 if there is no such record, or nil and -1 if r
+// could not be read or is not a cdb.
+func Seek(r io.ReaderAt, key []byte) ([]byte, int) {
+	var buf [8]byte
+
+	h := Hash(key)
+
+	if read(r, buf[:], (h<<3)&2047) == -1 {
+		return nil, -1
+	}
+	lenhash := unpack(buf[4:])
+	if lenhash == 0 {
+		return nil, 0
+	}
+	poshash := unpack(buf[:])
+	h2 := (h >> 8) % lenhash
+
+	for loop := uint32(0); loop < lenhash; loop++ {
+		if read(r, buf[:], poshash+(h2<<3)) == -1 {
+			return nil, -1
+		}
+		pos := unpack(buf[4:])
+		if pos == 0 {
+			return nil, 0
+		}
+		if unpack(buf[:]) == h {
+			if read(r, buf[:], pos) == -1 {
+				return nil, -1
+			}
+			if unpack(buf[:]) == uint32(len(key)) {
+				switch match(r, key, pos+8) {
+				case -1:
+					return nil, -1
+				case 1:
+					data := make([]byte, unpack(buf[4:]))
+					if read(r, data, pos+8+uint32(len(key))) == -1 {
+						return nil, -1
+					}
+					return data, 1
+				}
+			}
+		}
+		h2++
+		if h2 == lenhash {
+			h2 = 0
+		}
+	}
+	return nil, 0
+}
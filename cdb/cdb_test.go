@@ -0,0 +1,104 @@
+package cdb
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func build(t *testing.T, records [][2]string) *os.File {
+	t.Helper()
+	fd, err := os.Create(filepath.Join(t.TempDir(), "test.cdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fd.Close() })
+
+	var m Make
+	if err := m.Start(fd); err != nil {
+		t.Fatal(err)
+	}
+	for _, it := range records {
+		if err := m.Add([]byte(it[0]), []byte(it[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestHash(t *testing.T) {
+	if h := Hash(nil); h != 5381 {
+		t.Errorf("Hash(\"\") = %d, want 5381", h)
+	}
+	if h := Hash([]byte("a")); h != (5381*33)^'a' {
+		t.Errorf("Hash(\"a\") = %d", h)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	records := [][2]string{
+		{"example.com", ""},
+		{"xn--e1afmkfd.xn--p1ai", ""},
+		{"joe@example.com", "first"},
+		{"joe@example.com", "second"}, /* duplicate: Seek finds the first */
+		{"", "empty key"},
+	}
+	for i := 0; i < 1000; i++ {
+		records = append(records, [2]string{"key" + strconv.Itoa(i), "data" + strconv.Itoa(i)})
+	}
+	fd := build(t, records)
+
+	want := map[string]string{
+		"example.com":           "",
+		"xn--e1afmkfd.xn--p1ai": "",
+		"joe@example.com":       "first",
+		"":                      "empty key",
+		"key0":                  "data0",
+		"key999":                "data999",
+	}
+	for key, data := range want {
+		got, r := Seek(fd, []byte(key))
+		if r != 1 {
+			t.Errorf("Seek(%q): r = %d, want 1", key, r)
+			continue
+		}
+		if string(got) != data {
+			t.Errorf("Seek(%q) = %q, want %q", key, got, data)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		if got, r := Seek(fd, []byte(key)); r != 1 || string(got) != "data"+strconv.Itoa(i) {
+			t.Fatalf("Seek(%q) = %q, %d", key, got, r)
+		}
+	}
+
+	for _, key := range []string{"example.net", "Example.com", "joe@example", "key1000", "key"} {
+		if got, r := Seek(fd, []byte(key)); r != 0 || got != nil {
+			t.Errorf("Seek(%q) = %q, %d, want nil, 0", key, got, r)
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	fd := build(t, nil)
+	if _, r := Seek(fd, []byte("anything")); r != 0 {
+		t.Errorf("Seek in empty cdb: r = %d, want 0", r)
+	}
+}
+
+func TestNotCdb(t *testing.T) {
+	fd, err := os.Create(filepath.Join(t.TempDir(), "short"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	fd.WriteString("too short")
+	if _, r := Seek(fd, []byte("x")); r != -1 {
+		t.Errorf("Seek in short file: r = %d, want -1", r)
+	}
+}
@@ -0,0 +1,150 @@
+package cdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errFull = errors.New("cdb: file too big")
+
+type hp struct {
+	h uint32
+	p uint32
+}
+
+// Make writes a cdb: Start it, Add every record, then Finish it.
+// Records are written as they come, so the output has to be seekable to go
+// back and fill in the header.
+type Make struct {
+	ws  io.WriteSeeker
+	bw  *bufio.Writer
+	pos uint32
+	hp  []hp
+}
+
+func pack(b []byte, u uint32) { binary.LittleEndian.PutUint32(b, u) }
+
+func (m *Make) posplus(n int) error {
+	if uint64(n) > 0xffffffff {
+		return errFull
+	}
+	newpos := m.pos + uint32(n)
+	if newpos < m.pos {
+		return errFull
+	}
+	m.pos = newpos
+	return nil
+}
+
+// Start begins a new cdb on ws.
+func (m *Make) Start(ws io.WriteSeeker) error {
+	m.ws = ws
+	m.bw = bufio.NewWriter(ws)
+	m.pos = 2048
+	m.hp = nil
+	if _, err := ws.Seek(int64(m.pos), io.SeekStart); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Add appends a record. Keys need not be unique; Seek finds the first.
+func (m *Make) Add(key, data []byte) error {
+	var buf [8]byte
+	pack(buf[:], uint32(len(key)))
+	pack(buf[4:], uint32(len(data)))
+	if _, err := m.bw.Write(buf[:]); err != nil {
+		return err
+	}
+	if _, err := m.bw.Write(key); err != nil {
+		return err
+	}
+	if _, err := m.bw.Write(data); err != nil {
+		return err
+	}
+
+	m.hp = append(m.hp, hp{Hash(key), m.pos})
+	if err := m.posplus(8); err != nil {
+		return err
+	}
+	if err := m.posplus(len(key)); err != nil {
+		return err
+	}
+	return m.posplus(len(data))
+}
+
+// Finish writes the hash tables and the header. It does not close ws.
+func (m *Make) Finish() error {
+	var final [2048]byte
+	var count [256]uint32
+	var start [256]uint32
+
+	for _, it := range m.hp {
+		count[it.h&255]++
+	}
+
+	memsize := uint32(1)
+	for i := range count {
+		if u := count[i] * 2; u > memsize {
+			memsize = u
+		}
+	}
+
+	/* sort the records into their tables */
+	u := uint32(0)
+	for i := range count {
+		u += count[i]
+		start[i] = u
+	}
+	split := make([]hp, len(m.hp))
+	for i := len(m.hp) - 1; i >= 0; i-- {
+		t := m.hp[i].h & 255
+		start[t]--
+		split[start[t]] = m.hp[i]
+	}
+
+	table := make([]hp, memsize)
+	for i := range count {
+		n := count[i] * 2
+
+		pack(final[i*8:], m.pos)
+		pack(final[i*8+4:], n)
+
+		for j := uint32(0); j < n; j++ {
+			table[j] = hp{}
+		}
+		for _, it := range split[start[i] : start[i]+count[i]] {
+			where := (it.h >> 8) % n
+			for table[where].p != 0 {
+				where++
+				if where == n {
+					where = 0
+				}
+			}
+			table[where] = it
+		}
+
+		for j := uint32(0); j < n; j++ {
+			var buf [8]byte
+			pack(buf[:], table[j].h)
+			pack(buf[4:], table[j].p)
+			if _, err := m.bw.Write(buf[:]); err != nil {
+				return err
+			}
+			if err := m.posplus(8); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := m.bw.Flush(); err != nil {
+		return err
+	}
+	if _, err := m.ws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := m.ws.Write(final[:])
+	return err
+}
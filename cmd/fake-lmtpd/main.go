@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"qmail-smtpd/fakelmtp"
+)
+
+/*
+ * An LMTP server for trying out the lmtp backend; see package fakelmtp
+ * for what it does with each recipient. Messages are appended to
+ * LMTP_OUT, or written to stderr.
+ */
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:2424", "`addr` to listen on, host:port or a unix socket path")
+	flag.Parse()
+
+	srv := &fakelmtp.Server{Out: os.Stderr}
+	if fn, ok := os.LookupEnv("LMTP_OUT"); ok {
+		fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fd.Close()
+		srv.Out = fd
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(*listen, "/") {
+		network = "unix"
+		os.Remove(*listen)
+	}
+	ln, err := net.Listen(network, *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go srv.Serve(conn)
+	}
+}
@@ -0,0 +1,93 @@
+// Package newcdb is what qmail-newmrh and qmail-newvrt have in common:
+// control/NAME is compiled into control/NAME.cdb by way of
+// control/NAME.tmp, so that qmail-smtpd never sees half a cdb.
+package newcdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"qmail-smtpd/cdb"
+)
+
+var auto_qmail = "/var/qmail"
+
+func init() {
+	v := os.Getenv("AUTO_QMAIL")
+	if v != "" {
+		auto_qmail = v
+	}
+}
+
+var prog string
+
+func die(what string, err error) {
+	fmt.Fprintf(os.Stderr, "%s: fatal: unable to %s: %v\n", prog, what, err)
+	os.Exit(111)
+}
+
+// Main compiles control/name on behalf of prog and exits 111 if it cannot.
+// keys turns each line, with trailing blanks taken off, into the keys for
+// it; empty lines and comments are skipped. All data is empty.
+func Main(progname, name string, keys func(line string) []string) {
+	prog = progname
+	fn := "control/" + name
+	fntmp := fn + ".tmp"
+	fncdb := fn + ".cdb"
+
+	if err := os.Chdir(auto_qmail); err != nil {
+		die("chdir to "+auto_qmail, err)
+	}
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		die("read "+fn, err)
+	}
+	defer fd.Close()
+
+	fdtemp, err := os.OpenFile(fntmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		die("write to "+fntmp, err)
+	}
+
+	var m cdb.Make
+	if err := m.Start(fdtemp); err != nil {
+		die("write to "+fntmp, err)
+	}
+
+	br := bufio.NewReader(fd)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			die("read "+fn, err)
+		}
+		line = strings.TrimRight(line, " \t\n")
+		if line != "" && line[0] != '#' {
+			for _, key := range keys(line) {
+				if err := m.Add([]byte(key), nil); err != nil {
+					die("write to "+fntmp, err)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if err := m.Finish(); err != nil {
+		die("write to "+fntmp, err)
+	}
+	if err := fdtemp.Sync(); err != nil {
+		die("write to "+fntmp, err)
+	}
+	if err := fdtemp.Close(); err != nil {
+		die("write to "+fntmp, err)
+	}
+
+	if err := os.Rename(fntmp, fncdb); err != nil {
+		die("move "+fntmp+" to "+fncdb, err)
+	}
+}
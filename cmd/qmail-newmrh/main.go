@@ -0,0 +1,18 @@
+package main
+
+/*
+ * qmail-newmrh compiles control/morercpthosts into control/morercpthosts.cdb,
+ * the way qmail-smtpd wants it: one key per domain, lowercased, with
+ * U-labels turned into A-labels (xn--...), empty data.
+ */
+
+import (
+	"qmail-smtpd/cmd/internal/newcdb"
+	"qmail-smtpd/punycode"
+)
+
+func main() {
+	newcdb.Main("qmail-newmrh", "morercpthosts", func(line string) []string {
+		return []string{punycode.ToASCII(line)}
+	})
+}
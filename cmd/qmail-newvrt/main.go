@@ -0,0 +1,33 @@
+package main
+
+/*
+ * qmail-newvrt compiles control/validrcptto into control/validrcptto.cdb,
+ * the way qmail-smtpd wants it: one key per line, lowercased, empty data,
+ * and one more for the domain of every line, so that qmail-smtpd knows
+ * which domains are checked. Domains are turned into A-labels (xn--...),
+ * as qmail-smtpd does with the recipient (see vrt_norm).
+ */
+
+import (
+	"strings"
+
+	"qmail-smtpd/cmd/internal/newcdb"
+	"qmail-smtpd/punycode"
+)
+
+func main() {
+	domains := map[string]bool{}
+	newcdb.Main("qmail-newvrt", "validrcptto", func(line string) []string {
+		j := strings.LastIndexByte(line, '@')
+		if j == -1 {
+			return []string{strings.ToLower(line)}
+		}
+		domain := punycode.ToASCII(line[j+1:])
+		keys := []string{strings.ToLower(line[:j+1]) + domain}
+		if !domains[domain] {
+			domains[domain] = true
+			keys = append(keys, domain)
+		}
+		return keys
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+/*
+ * qmail-queue puts a message into the qmail queue, as the one from
+ * qmail-1.03 does: the message on fd 0, the envelope on fd 1
+ * (Faddr\0Taddr\0...Taddr\0\0). On success it exits 0 and pokes
+ * lock/trigger for qmail-send; otherwise it exits with one of the codes
+ * that qmail-smtpd knows (see qmail_close):
+ *
+ *   11  address too long
+ *   52  timeout
+ *   53  write error
+ *   54  read error
+ *   61  cannot chdir to the qmail directory
+ *   62  cannot chdir to queue
+ *   63  trouble with pid/
+ *   64  trouble with mess/
+ *   65  trouble with intd/
+ *   66  trouble with todo/
+ *   81  internal bug
+ *   91  bad envelope
+ *
+ * The message goes to mess/<inode%23>/<inode>, named after the inode of
+ * its file in pid/, and the envelope to intd/<inode>, which is then
+ * linked into todo/. info/, local/ and remote/ are left to qmail-send.
+ * "make queue" sets up the directories.
+ */
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+const DEATH = 24 * time.Hour /* must be below qmail-send's OSSIFIED (36 hours) */
+const ADDR = 1003
+const auto_split = 23
+
+var auto_qmail = "/var/qmail"
+
+func init() {
+	v := os.Getenv("AUTO_QMAIL")
+	if v != "" {
+		auto_qmail = v
+	}
+}
+
+var messfn, intdfn, todofn string
+var flagmademess, flagmadeintd bool
+var messfd, intdfd *os.File
+
+func cleanup() {
+	if flagmadeintd {
+		intdfd.Truncate(0)
+		if os.Remove(intdfn) != nil {
+			return
+		}
+	}
+	if flagmademess {
+		messfd.Truncate(0)
+		if os.Remove(messfn) != nil {
+			return
+		}
+	}
+}
+
+func die(e int)  { os.Exit(e) }
+func die_write() { cleanup(); die(53) }
+func die_read()  { cleanup(); die(54) }
+func sigalrm()   { /* thou shalt not clean up here */ die(52) }
+func sigbug()    { die(81) }
+
+/* "Received: (qmail 1234 invoked by uid 0); 26 Sep 1995 04:46:54 -0000\n" */
+func received(pid, uid int, when time.Time) string {
+	invoked := "by uid " + strconv.Itoa(uid)
+	for _, it := range []struct{ name, how string }{
+		{"alias", "by alias"},
+		{"qmaild", "from network"},
+		{"qmails", "for bounce"},
+	} {
+		if u, err := user.Lookup(it.name); err == nil && u.Uid == strconv.Itoa(uid) {
+			invoked = it.how
+			break
+		}
+	}
+	return "Received: (qmail " + strconv.Itoa(pid) + " invoked " + invoked + "); " +
+		when.UTC().Format("2 Jan 2006 15:04:05") + " -0000\n"
+}
+
+func pidopen(pid int, start int64) (string, *os.File) {
+	for seq := 1; seq < 10; seq++ {
+		fn := "pid/" + strconv.Itoa(pid) + "." + strconv.FormatInt(start, 10) + "." + strconv.Itoa(seq)
+		fd, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return fn, fd
+		}
+	}
+	die(63)
+	return "", nil
+}
+
+/* copies r to w, dying of the right cause */
+func copyall(w *bufio.Writer, r io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				die_write()
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			die_read()
+		}
+	}
+}
+
+func getch(r *bufio.Reader) byte {
+	ch, err := r.ReadByte()
+	if err != nil {
+		die_read()
+	}
+	return ch
+}
+
+/* copies one address and its \0 */
+func copyaddr(w *bufio.Writer, r *bufio.Reader) {
+	for i := 0; i < ADDR; i++ {
+		ch := getch(r)
+		if w.WriteByte(ch) != nil {
+			die_write()
+		}
+		if ch == 0 {
+			return
+		}
+	}
+	die(11)
+}
+
+func main() {
+	defer func() {
+		if recover() != nil {
+			sigbug()
+		}
+	}()
+
+	umask(033)
+	if os.Chdir(auto_qmail) != nil {
+		die(61)
+	}
+	if os.Chdir("queue") != nil {
+		die(62)
+	}
+	mypid := os.Getpid()
+	uid := os.Getuid()
+	starttime := time.Now()
+	rcvd := received(mypid, uid, starttime)
+
+	time.AfterFunc(DEATH, sigalrm)
+
+	pidfn, fd := pidopen(mypid, starttime.Unix())
+	messfd = fd
+	fi, err := messfd.Stat()
+	if err != nil {
+		die(63)
+	}
+	messnum, ok := inode(fi)
+	if !ok {
+		die(63)
+	}
+	num := strconv.FormatUint(messnum, 10)
+	messfn = "mess/" + strconv.FormatUint(messnum%auto_split, 10) + "/" + num
+	todofn = "todo/" + num
+	intdfn = "intd/" + num
+
+	if os.Link(pidfn, messfn) != nil {
+		die(64)
+	}
+	if os.Remove(pidfn) != nil {
+		die(63)
+	}
+	flagmademess = true
+
+	ssout := bufio.NewWriter(messfd)
+	if _, err := ssout.WriteString(rcvd); err != nil {
+		die_write()
+	}
+	copyall(ssout, os.Stdin)
+	if ssout.Flush() != nil {
+		die_write()
+	}
+	if messfd.Sync() != nil {
+		die_write()
+	}
+
+	intdfd, err = os.OpenFile(intdfn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		die(65)
+	}
+	flagmadeintd = true
+
+	ssout = bufio.NewWriter(intdfd)
+	ssin := bufio.NewReader(os.Stdout) /* yes, the envelope is on fd 1 */
+	ssout.WriteString("u" + strconv.Itoa(uid) + "\x00")
+	ssout.WriteString("p" + strconv.Itoa(mypid) + "\x00")
+
+	if getch(ssin) != 'F' {
+		die(91)
+	}
+	ssout.WriteByte('F')
+	copyaddr(ssout, ssin)
+	for {
+		ch := getch(ssin)
+		if ch == 0 {
+			break
+		}
+		if ch != 'T' {
+			die(91)
+		}
+		ssout.WriteByte(ch)
+		copyaddr(ssout, ssin)
+	}
+	if ssout.Flush() != nil {
+		die_write()
+	}
+	if intdfd.Sync() != nil {
+		die_write()
+	}
+
+	if os.Link(intdfn, todofn) != nil {
+		die(66)
+	}
+
+	triggerpull()
+	die(0)
+}
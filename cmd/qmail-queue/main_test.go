@@ -0,0 +1,192 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+/* the test binary is qmail-queue when this is set */
+func TestMain(m *testing.M) {
+	if os.Getenv("QMAILQUEUE_TEST") != "" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+/* an empty queue, as "make queue" leaves it */
+func queue_make(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, it := range []string{"pid", "intd", "todo", "lock"} {
+		if err := os.MkdirAll(filepath.Join(dir, "queue", it), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < auto_split; i++ {
+		if err := os.MkdirAll(filepath.Join(dir, "queue", "mess", strconv.Itoa(i)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mkfifo(filepath.Join(dir, "queue", "lock", "trigger"), 0622); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+/* runs qmail-queue on dir; returns its exit code and pid */
+func queue_run(t *testing.T, dir, msg, env string) (int, int) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "envelope")
+	if err := os.WriteFile(fn, []byte(env), 0644); err != nil {
+		t.Fatal(err)
+	}
+	envfd, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer envfd.Close()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "QMAILQUEUE_TEST=1", "AUTO_QMAIL="+dir)
+	cmd.Stdin = strings.NewReader(msg)
+	cmd.Stdout = envfd /* read from, as fd 1 */
+	err = cmd.Run()
+	var ee *exec.ExitError
+	if err != nil && !errors.As(err, &ee) {
+		t.Fatal(err)
+	}
+	return cmd.ProcessState.ExitCode(), cmd.ProcessState.Pid()
+}
+
+/* the names in dir/queue/sub, and below for mess */
+func queue_list(t *testing.T, dir, sub string) []string {
+	t.Helper()
+	var names []string
+	root := filepath.Join(dir, "queue", sub)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			names = append(names, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestQueue(t *testing.T) {
+	dir := queue_make(t)
+	trigger, err := os.OpenFile(filepath.Join(dir, "queue", "lock", "trigger"), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trigger.Close()
+
+	msg := "Subject: hello\n\nhi there\n"
+	code, pid := queue_run(t, dir, msg, "Fjoe@example.com\x00Tann@example.org\x00Tbob@example.org\x00\x00")
+	if code != 0 {
+		t.Fatalf("exit %d", code)
+	}
+
+	mess := queue_list(t, dir, "mess")
+	if len(mess) != 1 {
+		t.Fatalf("mess: %q", mess)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "queue", "mess", mess[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino, _ := inode(fi)
+	num := strconv.FormatUint(ino, 10)
+	if want := filepath.Join(strconv.FormatUint(ino%auto_split, 10), num); mess[0] != want {
+		t.Errorf("mess: got %s, want %s", mess[0], want)
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "queue", "mess", mess[0]))
+	rcvd := "Received: (qmail " + strconv.Itoa(pid) + " invoked "
+	if !strings.HasPrefix(string(b), rcvd) || !strings.HasSuffix(string(b), " -0000\n"+msg) {
+		t.Errorf("message: got %q", b)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Errorf("message mode: got %v", fi.Mode().Perm())
+	}
+
+	want := "u" + strconv.Itoa(os.Getuid()) + "\x00p" + strconv.Itoa(pid) + "\x00" +
+		"Fjoe@example.com\x00Tann@example.org\x00Tbob@example.org\x00"
+	for _, it := range []string{"intd", "todo"} {
+		names := queue_list(t, dir, it)
+		if len(names) != 1 || names[0] != num {
+			t.Errorf("%s: got %q, want %s", it, names, num)
+			continue
+		}
+		b, _ := os.ReadFile(filepath.Join(dir, "queue", it, num))
+		if string(b) != want {
+			t.Errorf("%s: got %q, want %q", it, b, want)
+		}
+	}
+	if names := queue_list(t, dir, "pid"); len(names) != 0 {
+		t.Errorf("pid: left %q", names)
+	}
+
+	var buf [2]byte
+	if n, _ := trigger.Read(buf[:]); n != 1 {
+		t.Errorf("trigger: read %d bytes", n)
+	}
+}
+
+func TestQueueErrors(t *testing.T) {
+	long := strings.Repeat("a", ADDR) + "@example.org"
+	for _, tt := range []struct {
+		name  string
+		env   string
+		code  int
+		clean bool /* mess and intd removed too */
+	}{
+		{"long sender", "F" + long + "\x00Tann@example.org\x00\x00", 11, false},
+		{"long recipient", "Fjoe@example.com\x00T" + long + "\x00\x00", 11, false},
+		{"no envelope", "", 54, true},
+		{"cut short", "Fjoe@example.com\x00Tann@exa", 54, true},
+		{"no final zero", "Fjoe@example.com\x00Tann@example.org\x00", 54, true},
+		{"no F", "Tann@example.org\x00\x00", 91, false},
+		{"no T", "Fjoe@example.com\x00Xann@example.org\x00\x00", 91, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := queue_make(t)
+			code, _ := queue_run(t, dir, "Subject: hello\n\nhi\n", tt.env)
+			if code != tt.code {
+				t.Errorf("exit %d, want %d", code, tt.code)
+			}
+			/*
+			 * nothing in todo for qmail-send to find. As in qmail-1.03, only
+			 * read and write errors clean up after themselves; otherwise
+			 * qmail-send throws out mess and intd once they are old.
+			 */
+			dirs := []string{"pid", "todo"}
+			if tt.clean {
+				dirs = append(dirs, "mess", "intd")
+			}
+			for _, it := range dirs {
+				if names := queue_list(t, dir, it); len(names) != 0 {
+					t.Errorf("%s: left %q", it, names)
+				}
+			}
+		})
+	}
+
+	code, _ := queue_run(t, t.TempDir(), "", "")
+	if code != 62 {
+		t.Errorf("no queue: exit %d, want 62", code)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+/* no inodes to name messages after, so no queue */
+
+func umask(mask int) {}
+
+func inode(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+func triggerpull() {}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func umask(mask int) {
+	syscall.Umask(mask)
+}
+
+func inode(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Ino), true
+}
+
+/* lock/trigger is a fifo that qmail-send watches; nobody listening is fine */
+func triggerpull() {
+	fd, err := os.OpenFile("lock/trigger", os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return
+	}
+	fd.Write([]byte{0})
+	fd.Close()
+}
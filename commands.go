@@ -1,19 +1,18 @@
 package main
 
 import (
-	"bufio"
 	"strings"
 )
 
 type tCommands struct {
 	text  string
-	fun   func(string)
-	flush func()
+	fun   func(*Session, string)
+	flush func(*Session)
 }
 
-func commands(ss *bufio.Reader, c []tCommands) int {
+func commands(s *Session, c []tCommands) int {
 	for {
-		cmd, err := ss.ReadString('\n')
+		cmd, err := s.ssin.ReadString('\n')
 		if err != nil {
 			return -1
 		}
@@ -42,9 +41,9 @@ func commands(ss *bufio.Reader, c []tCommands) int {
 					break
 				}
 			}
-			c[i].fun(arg)
+			c[i].fun(s, arg)
 			if c[i].flush != nil {
-				c[i].flush()
+				c[i].flush(s)
 			}
 		}
 	}
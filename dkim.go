@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"hash"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * DKIM (rfc 6376, rfc 8463) verification.
+ *
+ * If DKIMVERIFY is set or control/dkimreject exists, the message is held
+ * back (see qmail_hold) while put() feeds it through the verifier, and
+ * when it is complete an Authentication-Results header (rfc 8601) goes in
+ * front of it. Only rsa-sha256 and ed25519-sha256 are accepted, and at
+ * most five signatures per message are looked at.
+ *
+ * control/dkimreject lists author domains, one per line. A message whose
+ * From: is in one of them is refused unless a signature by that domain,
+ * or a parent of it, passes.
+ *
+ * Incoming Authentication-Results headers with our authserv-id are
+ * dropped (see hdrfilter.go); others are left alone.
+ */
+
+const dkim_maxsigs = 5
+const dkim_maxheader = 256 * 1024
+
+var dkimok bool
+var dkimrejectok bool
+var mapdkimreject = tConstmap{}
+
+func dkim_init() int {
+	if _, ok := os.LookupEnv("DKIMVERIFY"); ok {
+		dkimok = true
+	}
+	ss, r := control_readfile("control/dkimreject", false)
+	if r != 1 {
+		return r
+	}
+	for i := range ss {
+		ss[i] = strings.ToLower(ss[i])
+	}
+	constmap_init(mapdkimreject, ss)
+	dkimrejectok = true
+	dkimok = true
+	return 0
+}
+
+/* the canonicalized body, into a hash; rfc 6376 3.4.3 and 3.4.4 */
+type tDkimBody struct {
+	h       hash.Hash
+	relaxed bool
+	limit   int64 /* l=, or -1 */
+	n       int64
+	linelen int
+	empties int  /* empty lines not written yet; trailing ones never are */
+	wsp     bool /* relaxed: whitespace not written yet */
+	wrote   bool
+}
+
+func (b *tDkimBody) write(s string) {
+	b.wrote = true
+	if b.limit >= 0 {
+		if b.n >= b.limit {
+			return
+		}
+		if int64(len(s)) > b.limit-b.n {
+			s = s[:b.limit-b.n]
+		}
+	}
+	b.n += int64(len(s))
+	b.h.Write([]byte(s))
+}
+
+func (b *tDkimBody) put(ch byte) {
+	if ch == '\n' {
+		if b.linelen == 0 {
+			b.empties++
+		} else {
+			b.write("\r\n")
+		}
+		b.linelen = 0
+		b.wsp = false
+		return
+	}
+	if b.relaxed && (ch == ' ' || ch == '\t') {
+		b.wsp = true
+		return
+	}
+	if b.linelen == 0 {
+		for ; b.empties > 0; b.empties-- {
+			b.write("\r\n")
+		}
+	}
+	if b.wsp {
+		b.write(" ")
+		b.wsp = false
+	}
+	b.write(string(ch))
+	b.linelen++
+}
+
+func (b *tDkimBody) finish() []byte {
+	if b.linelen > 0 {
+		b.write("\r\n")
+	}
+	if !b.wrote && !b.relaxed {
+		b.write("\r\n")
+	}
+	return b.h.Sum(nil)
+}
+
+type tDkimSig struct {
+	field   string /* the whole DKIM-Signature field */
+	result  string /* pass, fail, neutral, temperror, permerror; "" while pending */
+	reason  string
+	a       string
+	d       string
+	s       string
+	i       string
+	h       []string
+	b       []byte
+	bh      []byte
+	hcanon  string
+	body    tDkimBody
+	expires int64 /* x=, or 0 */
+}
+
+type tDkim struct {
+	inbody bool
+	line   []byte
+	fields []string /* lines joined by \r\n, without the final one */
+	hsize  int
+	toobig bool
+	sigs   []*tDkimSig
+}
+
+func (s *Session) dkim_start() {
+	s.dkim = &tDkim{}
+	qmail_hold(&s.qqt)
+}
+
+func dkim_fieldname(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.ToLower(strings.TrimRight(name, " \t"))
+}
+
+/* tag=value; tag=value (rfc 6376 3.2) */
+func dkim_tags(value string) (map[string]string, bool) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(value, ";") {
+		spec = strings.Trim(spec, " \t\r\n")
+		if spec == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, false
+		}
+		name = strings.Trim(name, " \t\r\n")
+		if name == "" {
+			return nil, false
+		}
+		if _, dup := tags[name]; dup {
+			return nil, false
+		}
+		tags[name] = strings.Trim(val, " \t\r\n")
+	}
+	return tags, true
+}
+
+func dkim_nowsp(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func dkim_parsesig(field string) *tDkimSig {
+	sig := &tDkimSig{field: field}
+	_, value, _ := strings.Cut(field, ":")
+	tags, ok := dkim_tags(value)
+	if !ok {
+		sig.result, sig.reason = "permerror", "bad tag list"
+		return sig
+	}
+
+	sig.a = strings.ToLower(tags["a"])
+	sig.d = strings.ToLower(tags["d"])
+	sig.s = tags["s"]
+	sig.i = tags["i"]
+	if tags["v"] != "1" || sig.d == "" || sig.s == "" || tags["b"] == "" || tags["bh"] == "" || tags["h"] == "" {
+		sig.result, sig.reason = "permerror", "missing or bad required tag"
+		return sig
+	}
+	if sig.a != "rsa-sha256" && sig.a != "ed25519-sha256" {
+		sig.result, sig.reason = "permerror", "unsupported algorithm"
+		return sig
+	}
+	if q, ok := tags["q"]; ok && !strings.Contains(strings.ToLower(q), "dns/txt") {
+		sig.result, sig.reason = "permerror", "unsupported query method"
+		return sig
+	}
+
+	var err error
+	if sig.b, err = base64.StdEncoding.DecodeString(dkim_nowsp(tags["b"])); err != nil {
+		sig.result, sig.reason = "permerror", "bad b="
+		return sig
+	}
+	if sig.bh, err = base64.StdEncoding.DecodeString(dkim_nowsp(tags["bh"])); err != nil {
+		sig.result, sig.reason = "permerror", "bad bh="
+		return sig
+	}
+
+	from := false
+	for _, it := range strings.Split(tags["h"], ":") {
+		it = strings.ToLower(dkim_nowsp(it))
+		sig.h = append(sig.h, it)
+		if it == "from" {
+			from = true
+		}
+	}
+	if !from {
+		sig.result, sig.reason = "permerror", "From not signed"
+		return sig
+	}
+
+	if sig.i != "" {
+		j := strings.LastIndexByte(sig.i, '@')
+		idomain := strings.ToLower(sig.i[j+1:])
+		if j == -1 || (idomain != sig.d && !strings.HasSuffix(idomain, "."+sig.d)) {
+			sig.result, sig.reason = "permerror", "i= not in d="
+			return sig
+		}
+	}
+
+	hc, bc, _ := strings.Cut(strings.ToLower(tags["c"]), "/")
+	if hc == "" {
+		hc = "simple"
+	}
+	if bc == "" {
+		bc = "simple"
+	}
+	if (hc != "simple" && hc != "relaxed") || (bc != "simple" && bc != "relaxed") {
+		sig.result, sig.reason = "permerror", "bad c="
+		return sig
+	}
+	sig.hcanon = hc
+
+	sig.body = tDkimBody{h: sha256.New(), relaxed: bc == "relaxed", limit: -1}
+	if l, ok := tags["l"]; ok {
+		if sig.body.limit, err = strconv.ParseInt(l, 10, 64); err != nil || sig.body.limit < 0 {
+			sig.result, sig.reason = "permerror", "bad l="
+			return sig
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		if sig.expires, err = strconv.ParseInt(x, 10, 64); err != nil {
+			sig.result, sig.reason = "permerror", "bad x="
+			return sig
+		}
+	}
+	return sig
+}
+
+func (d *tDkim) endheader() {
+	d.inbody = true
+	if d.toobig {
+		return
+	}
+	for _, field := range d.fields {
+		if len(d.sigs) == dkim_maxsigs {
+			break
+		}
+		if dkim_fieldname(field) == "dkim-signature" {
+			d.sigs = append(d.sigs, dkim_parsesig(field))
+		}
+	}
+}
+
+func (d *tDkim) headerline() {
+	line := string(d.line)
+	d.line = d.line[:0]
+	if line == "" {
+		d.endheader()
+		return
+	}
+	if d.toobig {
+		return
+	}
+	if (line[0] == ' ' || line[0] == '\t') && len(d.fields) > 0 {
+		d.fields[len(d.fields)-1] += "\r\n" + line
+		return
+	}
+	d.fields = append(d.fields, line)
+}
+
+func dkim_put(d *tDkim, ch byte) {
+	if d.inbody {
+		for _, sig := range d.sigs {
+			if sig.result == "" {
+				sig.body.put(ch)
+			}
+		}
+		return
+	}
+	if ch == '\n' {
+		d.headerline()
+		return
+	}
+	d.hsize++
+	if d.hsize > dkim_maxheader {
+		d.toobig = true
+		return
+	}
+	d.line = append(d.line, ch)
+}
+
+func dkim_canonheader(field, canon string) string {
+	if canon == "simple" {
+		return field + "\r\n"
+	}
+	name, value, _ := strings.Cut(field, ":")
+	name = strings.ToLower(strings.TrimRight(name, " \t"))
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == '\t' }), " ")
+	return name + ":" + value + "\r\n"
+}
+
+/* the signature field with the value of b= taken out */
+func dkim_stripb(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	specs := strings.Split(value, ";")
+	for i, spec := range specs {
+		tag, _, ok := strings.Cut(spec, "=")
+		if ok && strings.Trim(tag, " \t\r\n") == "b" {
+			specs[i] = spec[:strings.IndexByte(spec, '=')+1]
+		}
+	}
+	return name + ":" + strings.Join(specs, ";")
+}
+
+func (d *tDkim) headerhash(sig *tDkimSig) []byte {
+	h := sha256.New()
+	used := map[string]int{}
+	for _, name := range sig.h {
+		n := used[name]
+		for i := len(d.fields) - 1; i >= 0; i-- {
+			if dkim_fieldname(d.fields[i]) != name {
+				continue
+			}
+			if n > 0 {
+				n--
+				continue
+			}
+			h.Write([]byte(dkim_canonheader(d.fields[i], sig.hcanon)))
+			break
+		}
+		used[name]++
+	}
+	h.Write([]byte(strings.TrimSuffix(dkim_canonheader(dkim_stripb(sig.field), sig.hcanon), "\r\n")))
+	return h.Sum(nil)
+}
+
+func dkim_key(sig *tDkimSig) (crypto.PublicKey, string, string) {
+	ctx, cancel := dns_ctx()
+	defer cancel()
+	txts, err := resolver.LookupTXT(ctx, sig.s+"._domainkey."+sig.d)
+	if err != nil {
+		if dns_notfound(err) {
+			return nil, "permerror", "no key"
+		}
+		return nil, "temperror", "key lookup failed"
+	}
+	if len(txts) != 1 {
+		return nil, "permerror", "no unique key"
+	}
+	tags, ok := dkim_tags(txts[0])
+	if !ok {
+		return nil, "permerror", "bad key record"
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, "permerror", "bad key record"
+	}
+	if hs, ok := tags["h"]; ok && !strings.Contains(strings.ToLower(hs), "sha256") {
+		return nil, "permerror", "key does not allow sha256"
+	}
+	if t, ok := tags["t"]; ok && sig.i != "" {
+		for _, flag := range strings.Split(t, ":") {
+			if strings.TrimSpace(flag) == "s" && strings.ToLower(sig.i[strings.LastIndexByte(sig.i, '@')+1:]) != sig.d {
+				return nil, "permerror", "i= not allowed by key"
+			}
+		}
+	}
+	p, err := base64.StdEncoding.DecodeString(dkim_nowsp(tags["p"]))
+	if err != nil {
+		return nil, "permerror", "bad key"
+	}
+	if len(p) == 0 {
+		return nil, "permerror", "key revoked"
+	}
+
+	k := strings.ToLower(tags["k"])
+	if k == "" {
+		k = "rsa"
+	}
+	switch {
+	case k == "rsa" && sig.a == "rsa-sha256":
+		pub, err := x509.ParsePKIXPublicKey(p)
+		if err != nil {
+			if pub, err = x509.ParsePKCS1PublicKey(p); err != nil {
+				return nil, "permerror", "bad key"
+			}
+		}
+		rsapub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, "permerror", "bad key"
+		}
+		if rsapub.N.BitLen() < 1024 {
+			return nil, "permerror", "key too short"
+		}
+		return rsapub, "", ""
+	case k == "ed25519" && sig.a == "ed25519-sha256":
+		if len(p) != ed25519.PublicKeySize {
+			return nil, "permerror", "bad key"
+		}
+		return ed25519.PublicKey(p), "", ""
+	}
+	return nil, "permerror", "key type does not match a="
+}
+
+func (d *tDkim) verify(sig *tDkimSig) {
+	if !bytes.Equal(sig.body.finish(), sig.bh) {
+		sig.result, sig.reason = "fail", "body hash did not verify"
+		return
+	}
+	if sig.expires != 0 && sig.expires < time.Now().Unix() {
+		sig.result, sig.reason = "fail", "signature expired"
+		return
+	}
+	key, result, reason := dkim_key(sig)
+	if key == nil {
+		sig.result, sig.reason = result, reason
+		return
+	}
+	digest := d.headerhash(sig)
+	ok := false
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig.b) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, digest, sig.b)
+	}
+	if !ok {
+		sig.result, sig.reason = "fail", "signature did not verify"
+		return
+	}
+	sig.result = "pass"
+}
+
+func (d *tDkim) fromdomain() string {
+	for _, field := range d.fields {
+		if dkim_fieldname(field) != "from" {
+			continue
+		}
+		_, value, _ := strings.Cut(field, ":")
+		addrs, err := mail.ParseAddressList(strings.ReplaceAll(value, "\r\n", ""))
+		if err != nil || len(addrs) == 0 {
+			return ""
+		}
+		j := strings.LastIndexByte(addrs[0].Address, '@')
+		return strings.ToLower(addrs[0].Address[j+1:])
+	}
+	return ""
+}
+
+/* token, or a quoted-string with anything odd replaced */
+func dkim_value(s string) string {
+	for i := 0; i < len(s); i++ {
+		if !issafe(s[i]) {
+			return spf_quote(s)
+		}
+	}
+	if s == "" {
+		return `""`
+	}
+	return s
+}
+
+/* Authentication-Results for the message, and a reply if it has to go */
+func (s *Session) dkim_finish() (string, tReply) {
+	d := s.dkim
+	s.dkim = nil
+	if !d.inbody {
+		d.endheader()
+	}
+
+	header := "Authentication-Results: " + dkim_value(authservid()) + ";"
+	if d.toobig {
+		header += "\n\tdkim=permerror reason=\"header too big\""
+	} else if len(d.sigs) == 0 {
+		header += " dkim=none"
+	}
+
+	for i, sig := range d.sigs {
+		if sig.result == "" {
+			d.verify(sig)
+		}
+		if i > 0 {
+			header += ";"
+		}
+		header += "\n\tdkim=" + sig.result
+		if sig.reason != "" {
+			header += " reason=" + spf_quote(sig.reason)
+		}
+		if sig.d != "" {
+			header += " header.d=" + dkim_value(sig.d)
+		}
+		if sig.s != "" {
+			header += " header.s=" + dkim_value(sig.s)
+		}
+		if sig.i != "" {
+			header += " header.i=" + dkim_value(sig.i)
+		}
+		if sig.a != "" {
+			header += " header.a=" + dkim_value(sig.a)
+		}
+	}
+	header += "\n"
+
+	if !dkimrejectok {
+		return header, tReply{}
+	}
+	author := d.fromdomain()
+	if author == "" || !constmap(mapdkimreject, author) {
+		return header, tReply{}
+	}
+	temp := false
+	for _, sig := range d.sigs {
+		if sig.d != author && !strings.HasSuffix(author, "."+sig.d) {
+			continue
+		}
+		switch sig.result {
+		case "pass":
+			return header, tReply{}
+		case "temperror":
+			temp = true
+		}
+	}
+	if temp {
+		return header, reply(451, "4.7.5", "unable to verify the DKIM signature of "+author+", try again later")
+	}
+	return header, reply(550, "5.7.20", "sorry, no valid DKIM signature for "+author)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * The signer here canonicalizes line by line, straight from rfc 6376
+ * 3.4, rather than byte by byte as dkim.go does, so that the two do not
+ * share their mistakes.
+ */
+
+func dkimtest_relaxed(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == '\t' }), " ")
+}
+
+var dkimtest_wsp = regexp.MustCompile(`[ \t]+`)
+
+func dkimtest_canonheader(field, canon string) string {
+	if canon == "simple" {
+		return field + "\r\n"
+	}
+	name, value, _ := strings.Cut(field, ":")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + dkimtest_relaxed(strings.ReplaceAll(value, "\r\n", "")) + "\r\n"
+}
+
+func dkimtest_canonbody(body, canon string) string {
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	if canon == "relaxed" {
+		for i := range lines {
+			lines[i] = strings.TrimRight(dkimtest_wsp.ReplaceAllString(lines[i], " "), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canon == "relaxed" {
+			return ""
+		}
+		return "\r\n"
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+type tDkimTestSig struct {
+	key crypto.Signer
+	d   string
+	s   string
+	c   string /* header/body */
+	l   int    /* -1 for no l= */
+	x   int64  /* 0 for no x= */
+}
+
+/* msg with a DKIM-Signature on top; msg has \n line ends */
+func dkimtest_sign(t *testing.T, msg string, ds tDkimTestSig) string {
+	t.Helper()
+	hdr, body, _ := strings.Cut(msg, "\n\n")
+	var fields []string
+	for _, line := range strings.Split(hdr, "\n") {
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	hc, bc, _ := strings.Cut(ds.c, "/")
+
+	cb := dkimtest_canonbody(body+"\n", bc)
+	tags := ""
+	if ds.l >= 0 {
+		cb = cb[:ds.l]
+		tags += fmt.Sprintf(" l=%d;", ds.l)
+	}
+	if ds.x != 0 {
+		tags += fmt.Sprintf(" x=%d;", ds.x)
+	}
+	bh := sha256.Sum256([]byte(cb))
+
+	a := "rsa-sha256"
+	if _, ok := ds.key.Public().(ed25519.PublicKey); ok {
+		a = "ed25519-sha256"
+	}
+	field := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=%s; d=%s; s=%s;%s\r\n\th=from:subject; bh=%s;\r\n\tb=",
+		a, ds.c, ds.d, ds.s, tags, base64.StdEncoding.EncodeToString(bh[:]))
+
+	h := sha256.New()
+	for _, name := range []string{"from", "subject"} {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(strings.TrimSpace(strings.SplitN(fields[i], ":", 2)[0]), name) {
+				h.Write([]byte(dkimtest_canonheader(fields[i], hc)))
+				break
+			}
+		}
+	}
+	h.Write([]byte(strings.TrimSuffix(dkimtest_canonheader(field, hc), "\r\n")))
+	digest := h.Sum(nil)
+
+	var b []byte
+	var err error
+	if a == "rsa-sha256" {
+		b, err = ds.key.Sign(rand.Reader, digest, crypto.SHA256)
+	} else {
+		b, err = ds.key.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	field += base64.StdEncoding.EncodeToString(b)
+	return strings.ReplaceAll(field, "\r\n", "\n") + "\n" + msg
+}
+
+/* the TXT record for key */
+func dkimtest_record(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	switch pub := key.Public().(type) {
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	default:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+}
+
+/* sends msg through a session; returns the stub queue and the reply to it */
+func dkimtest_send(t *testing.T, msg string) (*tStubQueue, int, string) {
+	t.Helper()
+	q := &tStubQueue{}
+	tc, done := session_pipe(t, q)
+	expect(t, tc, 220, "")
+	expect(t, tc, 250, "HELO client.example")
+	expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+	expect(t, tc, 250, "RCPT TO:<jane@test.local>")
+	expect(t, tc, 354, "DATA")
+	dw := tc.DotWriter()
+	dw.Write([]byte(msg))
+	dw.Close()
+	code, text, _ := tc.ReadResponse(0)
+	expect(t, tc, 221, "QUIT")
+	<-done
+	return q, code, text
+}
+
+/* the Authentication-Results we put on top, unfolded */
+func dkimtest_authres(q *tStubQueue) string {
+	msg := q.msg.String()
+	if !strings.HasPrefix(msg, "Authentication-Results: ") {
+		return ""
+	}
+	var lines []string
+	for i, line := range strings.Split(msg, "\n") {
+		if i > 0 && line[0] != '\t' {
+			break
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	return strings.Join(lines, " ")
+}
+
+func dkimtest_setup(t *testing.T) (crypto.Signer, crypto.Signer) {
+	t.Helper()
+	rsakey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone_use(t, "rsa._domainkey.example.com TXT "+dkimtest_record(t, rsakey)+"\n"+
+		"ed._domainkey.example.com TXT "+dkimtest_record(t, edkey)+"\n"+
+		"rsa._domainkey.broken.example TXT "+dkimtest_record(t, rsakey)+"\n")
+	resolver = tBrokenZone{resolver.(tZone)}
+
+	savedok, savedme, savedmeok := dkimok, me, meok
+	dkimok = true
+	me, meok = "test.local", true
+	t.Cleanup(func() { dkimok, me, meok = savedok, savedme, savedmeok })
+	return rsakey, edkey
+}
+
+const dkimtest_msg = "From: Joe <joe@example.com>\nSubject: hello there\nTo: jane@test.local\n\nhi  there \n\tsecond line\n\n\n"
+
+/* what relaxed canonicalization does not mind */
+func dkimtest_mangle(msg string) string {
+	return strings.NewReplacer(
+		"Subject: hello there\n", "subject :  hello\n   there \n",
+		"hi  there \n", "hi there\n",
+		"\tsecond line\n\n\n", " second\t line \n\n",
+	).Replace(msg)
+}
+
+func TestDkimVerify(t *testing.T) {
+	rsakey, edkey := dkimtest_setup(t)
+
+	for _, tt := range []struct {
+		name   string
+		sig    tDkimTestSig
+		change func(string) string
+		result string
+	}{
+		{"rsa simple", tDkimTestSig{rsakey, "example.com", "rsa", "simple/simple", -1, 0}, nil,
+			"dkim=pass header.d=example.com header.s=rsa header.a=rsa-sha256"},
+		{"rsa relaxed", tDkimTestSig{rsakey, "example.com", "rsa", "relaxed/relaxed", -1, 0}, dkimtest_mangle,
+			"dkim=pass header.d=example.com header.s=rsa header.a=rsa-sha256"},
+		{"ed25519 simple", tDkimTestSig{edkey, "example.com", "ed", "simple/simple", -1, 0}, nil,
+			"dkim=pass header.d=example.com header.s=ed header.a=ed25519-sha256"},
+		{"ed25519 relaxed", tDkimTestSig{edkey, "example.com", "ed", "relaxed/relaxed", -1, 0}, dkimtest_mangle,
+			"dkim=pass header.d=example.com header.s=ed header.a=ed25519-sha256"},
+		{"simple mangled", tDkimTestSig{rsakey, "example.com", "rsa", "simple/simple", -1, 0}, dkimtest_mangle,
+			`dkim=fail reason="body hash did not verify" header.d=example.com header.s=rsa header.a=rsa-sha256`},
+		{"simple header mangled", tDkimTestSig{edkey, "example.com", "ed", "simple/relaxed", -1, 0}, dkimtest_mangle,
+			`dkim=fail reason="signature did not verify" header.d=example.com header.s=ed header.a=ed25519-sha256`},
+		{"body changed", tDkimTestSig{rsakey, "example.com", "rsa", "relaxed/relaxed", -1, 0},
+			func(msg string) string { return strings.Replace(msg, "hi  there", "ho  there", 1) },
+			`dkim=fail reason="body hash did not verify" header.d=example.com header.s=rsa header.a=rsa-sha256`},
+		{"l= with more added", tDkimTestSig{rsakey, "example.com", "rsa", "simple/simple", 11, 0},
+			func(msg string) string { return msg + "buy now\n" },
+			"dkim=pass header.d=example.com header.s=rsa header.a=rsa-sha256"},
+		{"l= with the start changed", tDkimTestSig{rsakey, "example.com", "rsa", "simple/simple", 11, 0},
+			func(msg string) string { return strings.Replace(msg, "hi  there", "ho  there", 1) },
+			`dkim=fail reason="body hash did not verify" header.d=example.com header.s=rsa header.a=rsa-sha256`},
+		{"x= to come", tDkimTestSig{edkey, "example.com", "ed", "relaxed/simple", -1, time.Now().Unix() + 3600}, nil,
+			"dkim=pass header.d=example.com header.s=ed header.a=ed25519-sha256"},
+		{"x= gone", tDkimTestSig{edkey, "example.com", "ed", "relaxed/simple", -1, time.Now().Unix() - 3600}, nil,
+			`dkim=fail reason="signature expired" header.d=example.com header.s=ed header.a=ed25519-sha256`},
+		{"no key", tDkimTestSig{rsakey, "example.com", "nokey", "simple/simple", -1, 0}, nil,
+			`dkim=permerror reason="no key" header.d=example.com header.s=nokey header.a=rsa-sha256`},
+		{"key lookup fails", tDkimTestSig{rsakey, "broken.example", "rsa", "simple/simple", -1, 0}, nil,
+			`dkim=temperror reason="key lookup failed" header.d=broken.example header.s=rsa header.a=rsa-sha256`},
+		{"wrong key", tDkimTestSig{edkey, "example.com", "rsa", "simple/simple", -1, 0}, nil,
+			`dkim=permerror reason="key type does not match a=" header.d=example.com header.s=rsa header.a=ed25519-sha256`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := dkimtest_sign(t, dkimtest_msg, tt.sig)
+			if tt.change != nil {
+				msg = tt.change(msg)
+			}
+			q, code, _ := dkimtest_send(t, msg)
+			if code != 250 {
+				t.Fatalf("DATA: got %d", code)
+			}
+			want := "Authentication-Results: test.local; " + tt.result
+			if got := dkimtest_authres(q); got != want {
+				t.Errorf("got  %q\nwant %q", got, want)
+			}
+		})
+	}
+
+	q, _, _ := dkimtest_send(t, dkimtest_msg)
+	if got, want := dkimtest_authres(q), "Authentication-Results: test.local; dkim=none"; got != want {
+		t.Errorf("unsigned: got %q, want %q", got, want)
+	}
+}
+
+func TestDkimReject(t *testing.T) {
+	rsakey, _ := dkimtest_setup(t)
+	saved := mapdkimreject
+	dkimrejectok = true
+	mapdkimreject = tConstmap{}
+	constmap_init(mapdkimreject, []string{"example.com", "broken.example"})
+	t.Cleanup(func() { dkimrejectok, mapdkimreject = false, saved })
+
+	good := tDkimTestSig{rsakey, "example.com", "rsa", "relaxed/relaxed", -1, 0}
+	broken := tDkimTestSig{rsakey, "broken.example", "rsa", "relaxed/relaxed", -1, 0}
+	for _, tt := range []struct {
+		name string
+		msg  string
+		code int
+		text string
+	}{
+		{"pass", dkimtest_sign(t, dkimtest_msg, good), 250, ""},
+		{"unsigned", dkimtest_msg, 550, "5.7.20 sorry, no valid DKIM signature for example.com"},
+		{"fail", strings.Replace(dkimtest_sign(t, dkimtest_msg, good), "hi  there", "ho  there", 1), 550,
+			"5.7.20 sorry, no valid DKIM signature for example.com"},
+		{"other domain", dkimtest_sign(t, dkimtest_msg, broken), 550,
+			"5.7.20 sorry, no valid DKIM signature for example.com"},
+		{"temperror", dkimtest_sign(t, strings.Replace(dkimtest_msg, "joe@example.com", "joe@broken.example", 1), broken), 451,
+			"4.7.5 unable to verify the DKIM signature of broken.example, try again later"},
+		{"not listed", strings.Replace(dkimtest_msg, "joe@example.com", "joe@example.org", 1), 250, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			q, code, text := dkimtest_send(t, tt.msg)
+			if code != tt.code || (tt.text != "" && text != tt.text) {
+				t.Errorf("got %d %q, want %d %q", code, text, tt.code, tt.text)
+			}
+			if q.committed != (tt.code == 250) {
+				t.Errorf("committed: %v", q.committed)
+			}
+		})
+	}
+}
+
+func TestDkimAuthresOurs(t *testing.T) {
+	dkimtest_setup(t)
+
+	msg := "Authentication-Results: test.local; dkim=pass header.d=example.com\n" +
+		"Authentication-Results: (forged)\n TEST.local;\n\tdkim=pass\n" +
+		"Authentication-Results: \"test.local\"; spf=pass\n" +
+		"Authentication-Results: mx.example.org; dkim=pass header.d=example.com\n" +
+		"Authentication-Results: test.local.example.org; dkim=pass\n" +
+		"X-Authentication-Results: test.local; dkim=pass\n" +
+		dkimtest_msg
+	q, code, _ := dkimtest_send(t, msg)
+	if code != 250 {
+		t.Fatalf("DATA: got %d", code)
+	}
+	got := q.msg.String()
+	if n := strings.Count(got, "Authentication-Results: test.local;"); n != 2 {
+		t.Errorf("%d headers with our authserv-id, want ours and the X- one:\n%s", n, got)
+	}
+	for _, keep := range []string{
+		"\nAuthentication-Results: mx.example.org; dkim=pass header.d=example.com\n",
+		"\nAuthentication-Results: test.local.example.org; dkim=pass\n",
+		"\nX-Authentication-Results: test.local; dkim=pass\n",
+	} {
+		if !strings.Contains(got, keep) {
+			t.Errorf("dropped %q:\n%s", keep, got)
+		}
+	}
+	for _, drop := range []string{"\nAuthentication-Results: test.local; dkim=pass", "(forged)", "spf=pass"} {
+		if strings.Contains(got, drop) {
+			t.Errorf("kept %q:\n%s", drop, got)
+		}
+	}
+	if !strings.HasPrefix(got, "Authentication-Results: test.local; dkim=none\n") {
+		t.Errorf("our header: got %q", got)
+	}
+}
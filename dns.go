@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Every DNS lookup goes through resolver. It is net.DefaultResolver
+ * unless DNSZONE names a zone file, which then answers everything and
+ * keeps the network out of it:
+ *
+ *   # name type data
+ *   2.0.0.127.zen.example A 127.0.0.2
+ *   2.0.0.127.zen.example TXT listed, see http://zen.example/
+ *   example.com MX 10 mx.example.com
+ *
+ * Names are absolute, without the trailing dot.
+ */
+
+type tResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var resolver tResolver = net.DefaultResolver
+
+const dnstimeout = 30 * time.Second
+
+func dns_ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), dnstimeout)
+}
+
+func dns_notfound(err error) bool {
+	dnserr, ok := err.(*net.DNSError)
+	return ok && dnserr.IsNotFound
+}
+
+type tZone map[string][]tZoneRecord
+
+type tZoneRecord struct {
+	typ  string
+	data string
+}
+
+func zone_load(fn string) (tZone, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	z := tZone{}
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		f := strings.SplitN(line, " ", 3)
+		if len(f) < 3 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSuffix(f[0], "."))
+		z[name] = append(z[name], tZoneRecord{strings.ToUpper(f[1]), f[2]})
+	}
+	return z, sc.Err()
+}
+
+func (z tZone) lookup(name, typ string) ([]string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var data []string
+	for _, it := range z[name] {
+		if it.typ == typ {
+			data = append(data, it.data)
+		}
+	}
+	if len(data) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return data, nil
+}
+
+func (z tZone) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	ipa, _ := ip_fromnet(ip)
+	if ip_isv4(ipa) {
+		return z.lookup(ip_revname(ipa, "in-addr.arpa"), "PTR")
+	}
+	return z.lookup(ip_revname(ipa, "ip6.arpa"), "PTR")
+}
+
+func (z tZone) LookupHost(_ context.Context, host string) ([]string, error) {
+	a, err := z.lookup(host, "A")
+	aaaa, err6 := z.lookup(host, "AAAA")
+	if err != nil && err6 != nil {
+		return nil, err
+	}
+	return append(a, aaaa...), nil
+}
+
+func (z tZone) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	data, err := z.lookup(name, "MX")
+	if err != nil {
+		return nil, err
+	}
+	var mx []*net.MX
+	for _, it := range data {
+		pref, host, _ := strings.Cut(it, " ")
+		_, u := scan_ulong(pref)
+		mx = append(mx, &net.MX{Host: strings.TrimSpace(host), Pref: uint16(u)})
+	}
+	sort.Slice(mx, func(i, j int) bool { return mx[i].Pref < mx[j].Pref })
+	return mx, nil
+}
+
+func (z tZone) LookupTXT(_ context.Context, name string) ([]string, error) {
+	return z.lookup(name, "TXT")
+}
+
+func dns_init() int {
+	fn := os.Getenv("DNSZONE")
+	if fn == "" {
+		return 0
+	}
+	z, err := zone_load(fn)
+	if err != nil {
+		return -1
+	}
+	resolver = z
+	return 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/* answers every lookup from records, in the format of a DNSZONE file */
+func zone_use(t *testing.T, records string) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "zone")
+	if err := os.WriteFile(fn, []byte(records), 0644); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zone_load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := resolver
+	resolver = z
+	t.Cleanup(func() { resolver = saved })
+}
+
+func TestZone(t *testing.T) {
+	zone_use(t, `# name type data
+Example.COM. MX 20 mx2.example.com
+example.com MX 10 mx1.example.com
+example.com TXT v=spf1 -all
+mx1.example.com A 192.0.2.1
+mx1.example.com AAAA 2001:db8::1
+1.2.0.192.in-addr.arpa PTR mx1.example.com
+`)
+	ctx := context.Background()
+
+	mx, err := resolver.LookupMX(ctx, "example.com.")
+	if err != nil || len(mx) != 2 || mx[0].Host != "mx1.example.com" || mx[0].Pref != 10 {
+		t.Errorf("MX: got %v %v", mx, err)
+	}
+	addrs, err := resolver.LookupHost(ctx, "MX1.example.com")
+	if err != nil || len(addrs) != 2 || addrs[0] != "192.0.2.1" || addrs[1] != "2001:db8::1" {
+		t.Errorf("host: got %q %v", addrs, err)
+	}
+	txt, err := resolver.LookupTXT(ctx, "example.com")
+	if err != nil || len(txt) != 1 || txt[0] != "v=spf1 -all" {
+		t.Errorf("TXT: got %q %v", txt, err)
+	}
+	names, err := resolver.LookupAddr(ctx, "192.0.2.1")
+	if err != nil || len(names) != 1 || names[0] != "mx1.example.com" {
+		t.Errorf("PTR: got %q %v", names, err)
+	}
+	if _, err := resolver.LookupTXT(ctx, "nowhere.example"); !dns_notfound(err) {
+		t.Errorf("nowhere: got %v", err)
+	}
+}
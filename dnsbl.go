@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+ * DNS blocklists (rfc 5782).
+ *
+ * control/dnsbl has one list per line, zone[:code[:text]]:
+ *
+ *   zen.example
+ *   bl.example:451
+ *   dnsbl.example:554:sorry, we do not take mail from your network
+ *
+ * code defaults to 554. remoteip is looked up at connect; if it is
+ * listed, every RCPT gets the reply of the first list that has it,
+ * together with that list's TXT record. RELAYCLIENT and AUTH are exempt.
+ *
+ * Only answers in 127.0.0.0/8 mean listed; 127.255.255.0/24 is what lists
+ * give for errors, refused queries and the like, and is ignored.
+ */
+
+type tDnsbl struct {
+	zone string
+	code int
+	text string
+}
+
+var dnsblok bool
+var dnsbl []tDnsbl
+
+func dnsbl_init() int {
+	ss, r := control_readfile("control/dnsbl", false)
+	if r != 1 {
+		return r
+	}
+	for _, line := range ss {
+		f := strings.SplitN(line, ":", 3)
+		it := tDnsbl{zone: strings.TrimSuffix(f[0], "."), code: 554}
+		if len(f) > 1 && f[1] != "" {
+			i, u := scan_ulong(f[1])
+			if i != len(f[1]) || u < 400 || u > 599 {
+				return -1
+			}
+			it.code = int(u)
+		}
+		if len(f) > 2 {
+			it.text = f[2]
+		}
+		dnsbl = append(dnsbl, it)
+	}
+	dnsblok = true
+	return 0
+}
+
+/* 1 if one of addrs says listed */
+func dnsbl_listed(addrs []string) int {
+	for _, a := range addrs {
+		ip := net.ParseIP(a).To4()
+		if ip == nil || ip[0] != 127 {
+			continue
+		}
+		if ip[1] == 255 && ip[2] == 255 {
+			continue
+		}
+		return 1
+	}
+	return 0
+}
+
+func (s *Session) dnsbl_check() {
+	if !dnsblok || s.relayclientok {
+		return
+	}
+	nip := net.ParseIP(s.remoteip)
+	if nip == nil {
+		return
+	}
+	ip, _ := ip_fromnet(nip)
+
+	ctx, cancel := dns_ctx()
+	defer cancel()
+
+	for _, it := range dnsbl {
+		name := ip_revname(ip, it.zone) + "."
+		addrs, err := resolver.LookupHost(ctx, name)
+		if err != nil || dnsbl_listed(addrs) == 0 {
+			continue /* not listed, or the list is down: let it through */
+		}
+
+		text := it.text
+		if text == "" {
+			text = "sorry, your address " + s.remoteip + " is listed in " + it.zone
+		}
+		ecode := strconv.Itoa(it.code/100) + ".7.1"
+		lines := []string{text}
+		if txt, err := resolver.LookupTXT(ctx, name); err == nil {
+			lines = append(lines, rcptcheck_text([]byte(strings.Join(txt, "\n")))...)
+		}
+		s.dnsblreply = reply(it.code, ecode, lines...)
+		return
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDnsbl(t *testing.T) {
+	zone_use(t, `2.0.0.127.zen.example A 127.0.0.2
+2.0.0.127.zen.example TXT listed, see http://zen.example/2
+3.0.0.127.zen.example A 127.255.255.254
+4.0.0.127.zen.example A 192.0.2.1
+3.0.0.127.bl.example A 127.0.0.10
+5.0.0.127.bl.example A 127.0.0.4
+5.0.0.127.bl.example A 127.255.255.252
+`)
+	savedok, saved := dnsblok, dnsbl
+	dnsblok = true
+	dnsbl = []tDnsbl{
+		{zone: "zen.example", code: 554},
+		{zone: "bl.example", code: 451, text: "try again from elsewhere"},
+	}
+	t.Cleanup(func() { dnsblok, dnsbl = savedok, saved })
+
+	for _, tt := range []struct {
+		ip    string
+		reply string /* code ecode text, "" if not listed */
+	}{
+		{"127.0.0.1", ""},
+		{"127.0.0.2", "554 5.7.1 sorry, your address 127.0.0.2 is listed in zen.example\nlisted, see http://zen.example/2"},
+		{"127.0.0.3", "451 4.7.1 try again from elsewhere"}, /* 127.255.255.x from zen is an error */
+		{"127.0.0.4", ""}, /* outside 127/8 */
+		{"127.0.0.5", "451 4.7.1 try again from elsewhere"},
+		{"2001:db8::1", ""},
+	} {
+		var s Session
+		s.remoteip = tt.ip
+		s.dnsbl_check()
+		got := ""
+		if r := s.dnsblreply; r.code != 0 {
+			got = fmt.Sprintf("%d %s %s", r.code, r.ecode, strings.Join(r.text, "\n"))
+		}
+		if got != tt.reply {
+			t.Errorf("%s: got %q, want %q", tt.ip, got, tt.reply)
+		}
+	}
+
+	var s Session
+	s.remoteip = "127.0.0.2"
+	s.relayclientok = true
+	s.dnsbl_check()
+	if s.dnsblreply.code != 0 {
+		t.Errorf("RELAYCLIENT: got %v", s.dnsblreply)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+)
+
+/*
+ * DSN (rfc 3461).
+ *
+ * qmail-queue has no room for DSN data in its envelope, so it travels
+ * in the message header instead, written in front of the message
+ * right below our Received line, using the same keyword=xtext syntax
+ * as on the wire:
+ *
+ *   X-DSN-Envelope: RET=HDRS ENVID=QQ314159
+ *   X-DSN-Recipient: RCPT=joe@example.com NOTIFY=NEVER ORCPT=rfc822;joe@example.com
+ *
+ * RCPT is the recipient exactly as handed to qmail-queue, xtext-encoded.
+ * A header is only written if the client gave the matching parameters.
+ * Headers of these names in the message itself are dropped (see
+ * hdrfilter.go), so whatever is there is ours.
+ * Lines are folded; a value too long for one line is split across
+ * several, and whitespace within a value is to be ignored.
+ *
+ * The lmtp and smarthost backends also give the parameters to the next
+ * hop, on MAIL and RCPT, when it announces DSN.
+ */
+
+type tRcptDsn struct {
+	notify string
+	orcpt  string
+}
+
+func xtext_encode(s string) string {
+	var b strings.Builder
+	for _, ch := range []byte(s) {
+		if ch < 33 || ch > 126 || ch == '+' || ch == '=' {
+			b.WriteByte('+')
+			b.WriteByte("0123456789ABCDEF"[ch>>4])
+			b.WriteByte("0123456789ABCDEF"[ch&15])
+		} else {
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+/* RET=FULL|HDRS */
+func (s *Session) param_ret(value string) int {
+	value = strings.ToUpper(value)
+	if value != "FULL" && value != "HDRS" {
+		s.err_paramvalue()
+		return 0
+	}
+	s.dsnret = value
+	return 1
+}
+
+/* ENVID=xtext */
+func (s *Session) param_envid(value string) int {
+	if len(value) > 100 {
+		s.err_paramvalue()
+		return 0
+	}
+	if _, ok := xtext_decode(value); !ok {
+		s.err_paramvalue()
+		return 0
+	}
+	s.dsnenvid = value
+	return 1
+}
+
+/* NOTIFY=NEVER or NOTIFY=SUCCESS,FAILURE,DELAY */
+func (s *Session) param_notify(value string) int {
+	value = strings.ToUpper(value)
+	seen := map[string]bool{}
+	for _, it := range strings.Split(value, ",") {
+		switch it {
+		case "NEVER":
+			if value != "NEVER" {
+				s.err_paramvalue()
+				return 0
+			}
+		case "SUCCESS", "FAILURE", "DELAY":
+			if seen[it] {
+				s.err_paramvalue()
+				return 0
+			}
+			seen[it] = true
+		default:
+			s.err_paramvalue()
+			return 0
+		}
+	}
+	s.dsnnotify = value
+	return 1
+}
+
+/* ORCPT=addr-type;xtext */
+func (s *Session) param_orcpt(value string) int {
+	if len(value) > 500 {
+		s.err_paramvalue()
+		return 0
+	}
+	typ, xtext, ok := strings.Cut(value, ";")
+	if !ok || !iskeyword(typ) {
+		s.err_paramvalue()
+		return 0
+	}
+	if _, ok := xtext_decode(xtext); !ok || xtext == "" {
+		s.err_paramvalue()
+		return 0
+	}
+	s.dsnorcpt = value
+	return 1
+}
+
+/* the parameters as on MAIL, " RET=HDRS ENVID=QQ314159" */
+func dsn_mailparams(dsn tEnvDsn) string {
+	x := ""
+	if dsn.ret != "" {
+		x += " RET=" + dsn.ret
+	}
+	if dsn.envid != "" {
+		x += " ENVID=" + dsn.envid
+	}
+	return x
+}
+
+/* the parameters as on RCPT */
+func dsn_rcptparams(rd tRcptDsn) string {
+	x := ""
+	if rd.notify != "" {
+		x += " NOTIFY=" + rd.notify
+	}
+	if rd.orcpt != "" {
+		x += " ORCPT=" + rd.orcpt
+	}
+	return x
+}
+
+/* name: word word..., folded at 78 columns, never longer than 998 */
+func dsn_header(name string, words []string) string {
+	x := name + ":"
+	col := len(x)
+	for _, w := range words {
+		if col+1+len(w) > 78 && col > len(name)+1 {
+			x += "\n"
+			col = 0
+		}
+		x += " "
+		col++
+		for col+len(w) > 998 {
+			n := 998 - col
+			x += w[:n] + "\n "
+			w = w[n:]
+			col = 1
+		}
+		x += w
+		col += len(w)
+	}
+	return x + "\n"
+}
+
+/* as hdr_named: 1 if field pretends to be one of our X-DSN headers */
+func dsn_ours(field []byte, final bool) int {
+	r := 0
+	for _, name := range []string{"x-dsn-envelope", "x-dsn-recipient"} {
+		switch hdr_named(field, final, name) {
+		case 1:
+			return 1
+		case -1:
+			r = -1
+		}
+	}
+	return r
+}
+
+func (s *Session) dsn_putheaders() {
+	if s.dsnret != "" || s.dsnenvid != "" {
+		var words []string
+		if s.dsnret != "" {
+			words = append(words, "RET="+s.dsnret)
+		}
+		if s.dsnenvid != "" {
+			words = append(words, "ENVID="+s.dsnenvid)
+		}
+		qmail_puts(&s.qqt, dsn_header("X-DSN-Envelope", words))
+	}
+
+	for i, it := range s.rcptdsn {
+		if it.notify == "" && it.orcpt == "" {
+			continue
+		}
+		words := []string{"RCPT=" + xtext_encode(s.rcptto[i])}
+		if it.notify != "" {
+			words = append(words, "NOTIFY="+it.notify)
+		}
+		if it.orcpt != "" {
+			words = append(words, "ORCPT="+it.orcpt)
+		}
+		qmail_puts(&s.qqt, dsn_header("X-DSN-Recipient", words))
+	}
+}
@@ -0,0 +1,109 @@
+// Package fakelmtp is an LMTP server for trying out and testing the lmtp
+// backend. What happens to a recipient depends on how its local part
+// begins:
+//
+//	refuse   550 at RCPT
+//	defer    450 at RCPT
+//	fail     552 after DATA
+//	later    452 after DATA
+//
+// Everybody else gets the message.
+package fakelmtp
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Server writes the messages it gets to Out, each after a line with its
+// envelope.
+type Server struct {
+	mu  sync.Mutex
+	Out io.Writer
+}
+
+func local(addr string) string {
+	addr = strings.Trim(addr, "<>")
+	if j := strings.LastIndexByte(addr, '@'); j != -1 {
+		addr = addr[:j]
+	}
+	return strings.ToLower(addr)
+}
+
+// Serve speaks LMTP on conn until the client quits, then closes it.
+func (srv *Server) Serve(conn net.Conn) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 fake-lmtpd ready")
+
+	var from string
+	var rcpts []string
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			tc.PrintfLine("250-fake-lmtpd")
+			tc.PrintfLine("250-DSN")
+			tc.PrintfLine("250 PIPELINING")
+		case "MAIL":
+			from = strings.TrimPrefix(strings.TrimPrefix(arg, "FROM:"), "from:")
+			from, _, _ = strings.Cut(from, " ") /* no parameters */
+			rcpts = nil
+			tc.PrintfLine("250 2.1.0 ok")
+		case "RCPT":
+			to := arg[strings.IndexByte(arg, ':')+1:]
+			to, _, _ = strings.Cut(to, " ")
+			switch l := local(to); {
+			case strings.HasPrefix(l, "refuse"):
+				tc.PrintfLine("550 5.1.1 no such user")
+			case strings.HasPrefix(l, "defer"):
+				tc.PrintfLine("450 4.2.1 try again later")
+			default:
+				rcpts = append(rcpts, to)
+				tc.PrintfLine("250 2.1.5 ok")
+			}
+		case "DATA":
+			if len(rcpts) == 0 {
+				tc.PrintfLine("503 5.5.1 no valid recipients")
+				continue
+			}
+			tc.PrintfLine("354 go ahead")
+			data, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			for _, to := range rcpts {
+				switch l := local(to); {
+				case strings.HasPrefix(l, "fail"):
+					tc.PrintfLine("552 5.2.2 mailbox full")
+				case strings.HasPrefix(l, "later"):
+					tc.PrintfLine("452 4.2.2 mailbox full, try again later")
+				default:
+					srv.mu.Lock()
+					io.WriteString(srv.Out, "MAIL FROM:"+from+" RCPT TO:"+to+"\n")
+					srv.Out.Write(data)
+					srv.mu.Unlock()
+					tc.PrintfLine("250 2.0.0 %s delivered", to)
+				}
+			}
+			rcpts = nil
+		case "RSET":
+			rcpts = nil
+			tc.PrintfLine("250 2.0.0 ok")
+		case "NOOP":
+			tc.PrintfLine("250 2.0.0 ok")
+		case "QUIT":
+			tc.PrintfLine("221 2.0.0 bye")
+			return
+		default:
+			tc.PrintfLine("500 5.5.2 unrecognized command")
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Greylisting. A RCPT is deferred the first time its triplet (remoteip
+ * network, MAIL FROM, RCPT TO) is seen and accepted once the client has
+ * retried after control/greylist seconds. The network is the /24 for
+ * IPv4 and the /64 for IPv6, since big senders retry from another host.
+ * A triplet that got through stays good for greylist_lifetime; one that
+ * is not retried within greylist_retry has to start over.
+ *
+ * Triplets are kept in var/greylist, which has to be writable by the
+ * qmail-smtpd user. If it is not, mail goes through. Triplets older than
+ * greylist_lifetime are no use to anybody and are swept out once a day.
+ *
+ * RELAYCLIENT and AUTH are exempt, and so is everything matching
+ *
+ *   control/greylistips      addresses or networks, 192.0.2.1 or 2001:db8::/32
+ *   control/greylistdomains  domains of the sender or the recipient
+ */
+
+const greylist_retry = 24 * time.Hour
+const greylist_lifetime = 36 * 24 * time.Hour
+
+var greylistok bool
+var greylistdelay time.Duration
+var greylistips []*net.IPNet
+var mapgreylistdomains = tConstmap{}
+var greylist = tStore{"var/greylist"}
+
+func greylist_init() int {
+	i, r := control_readint("control/greylist")
+	if r != 1 {
+		return r
+	}
+	greylistdelay = time.Duration(i) * time.Second
+
+	ss, r := control_readfile("control/greylistips", false)
+	if r == -1 {
+		return -1
+	}
+	for _, it := range ss {
+		if !strings.Contains(it, "/") {
+			if strings.Contains(it, ":") {
+				it += "/128"
+			} else {
+				it += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(it)
+		if err != nil {
+			return -1
+		}
+		greylistips = append(greylistips, ipnet)
+	}
+
+	ss, r = control_readfile("control/greylistdomains", false)
+	if r == -1 {
+		return -1
+	}
+	for i := range ss {
+		ss[i] = domain_toascii(ss[i])
+	}
+	constmap_init(mapgreylistdomains, ss)
+
+	greylistok = true
+	return 0
+}
+
+func greylist_domain(addr string) bool {
+	j := strings.LastIndexByte(addr, '@')
+	if j == -1 {
+		return false
+	}
+	return constmap(mapgreylistdomains, domain_toascii(addr[j+1:]))
+}
+
+func (s *Session) err_greylist() {
+	s.reply_out(reply(451, "4.7.1", "greylisted, please try again later"))
+}
+
+/* 1 if the RCPT may go on, 0 if it has to wait */
+func (s *Session) greylist_check() int {
+	if !greylistok || s.relayclientok {
+		return 1
+	}
+	ip := net.ParseIP(s.remoteip)
+	if ip == nil {
+		return 1
+	}
+	for _, it := range greylistips {
+		if it.Contains(ip) {
+			return 1
+		}
+	}
+	if greylist_domain(s.mailfrom) || greylist_domain(s.addr) {
+		return 1
+	}
+
+	var network string
+	if ip4 := ip.To4(); ip4 != nil {
+		network = ip4.Mask(net.CIDRMask(24, 32)).String()
+	} else {
+		network = ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+	key := network + "\x00" + strings.ToLower(s.mailfrom) + "\x00" + strings.ToLower(s.addr)
+	store_expire(greylist, greylist_lifetime)
+
+	/* "time flag": when the triplet was first seen, or when it last got through if flag is 1 */
+	now := time.Now().Unix()
+	ok := false
+	r := store_update(greylist, key, func(data []byte) []byte {
+		f := strings.Fields(string(data))
+		var first int64 = -1
+		passed := false
+		if len(f) == 2 {
+			first, _ = strconv.ParseInt(f[0], 10, 64)
+			passed = f[1] == "1"
+		}
+		age := time.Duration(now-first) * time.Second
+
+		switch {
+		case first < 0 || age < 0:
+			first = now
+		case passed && age < greylist_lifetime:
+			ok = true
+			first = now
+		case !passed && age >= greylistdelay && age < greylist_retry:
+			ok = true
+			passed = true
+			first = now
+		case !passed && age < greylistdelay:
+		default:
+			first = now
+			passed = false
+		}
+
+		flag := "0"
+		if passed {
+			flag = "1"
+		}
+		return []byte(strconv.FormatInt(first, 10) + " " + flag + "\n")
+	})
+	if r == -1 || ok {
+		return 1
+	}
+	return 0
+}
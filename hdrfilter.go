@@ -0,0 +1,125 @@
+package main
+
+import "strings"
+
+/*
+ * Header fields that only we may write. put() holds each field of the
+ * incoming header back until it can tell whether the field claims to be
+ * one of ours, and drops it if so:
+ *
+ *   Authentication-Results with our authserv-id (see authres.go)
+ *   X-DSN-Envelope and X-DSN-Recipient (see dsn.go)
+ *
+ * Everything else goes through as it is. The DKIM verifier still sees the
+ * message as it was sent.
+ */
+
+const hdrfilter_maxfield = 4096 /* undecided after this much: drop it */
+
+type tHdrFilter struct {
+	inheader bool
+	nl       bool   /* last byte was \n */
+	field    []byte /* the field so far, while undecided */
+	state    int    /* 0 undecided, 1 passing, 2 dropping */
+}
+
+func hdrfilter_init(h *tHdrFilter) {
+	*h = tHdrFilter{inheader: true, nl: true}
+}
+
+/*
+ * 1 if field is called name (lowercase), 0 if not, -1 if more is needed to
+ * tell. final says there is no more.
+ */
+func hdr_named(field []byte, final bool, name string) int {
+	f := string(field)
+	i := strings.IndexByte(f, ':')
+	if i == -1 {
+		n := strings.ToLower(strings.TrimRight(f, " \t"))
+		if final || !strings.HasPrefix(name, n) {
+			return 0
+		}
+		return -1
+	}
+	if !strings.EqualFold(strings.TrimRight(f[:i], " \t"), name) {
+		return 0
+	}
+	return 1
+}
+
+/* as hdr_named: 1 if field has to go */
+func hdrfilter_ours(field []byte, final bool) int {
+	r := 0
+	for _, ours := range []func([]byte, bool) int{authres_ours, dsn_ours} {
+		switch ours(field, final) {
+		case 1:
+			return 1
+		case -1:
+			r = -1
+		}
+	}
+	return r
+}
+
+func (s *Session) hdrfilter_decide(final bool) {
+	h := &s.hdrfilter
+	r := hdrfilter_ours(h.field, final)
+	if r == -1 && len(h.field) > hdrfilter_maxfield {
+		r = 1
+	}
+	switch r {
+	case 0:
+		for _, ch := range h.field {
+			qmail_putc(&s.qqt, ch)
+		}
+		h.state = 1
+	case 1:
+		h.state = 2
+	default:
+		return
+	}
+	h.field = h.field[:0]
+}
+
+/* ch on its way to the queue */
+func (s *Session) hdrfilter_put(ch byte) {
+	h := &s.hdrfilter
+	if !h.inheader {
+		qmail_putc(&s.qqt, ch)
+		return
+	}
+	if h.nl {
+		h.nl = false
+		if ch != ' ' && ch != '\t' {
+			/* the field before is over */
+			if h.state == 0 && len(h.field) > 0 {
+				s.hdrfilter_decide(true)
+			}
+			h.state = 0
+			if ch == '\n' {
+				h.inheader = false
+				qmail_putc(&s.qqt, ch)
+				return
+			}
+		}
+	}
+	if ch == '\n' {
+		h.nl = true
+	}
+	switch h.state {
+	case 0:
+		h.field = append(h.field, ch)
+		s.hdrfilter_decide(false)
+	case 1:
+		qmail_putc(&s.qqt, ch)
+	}
+}
+
+/* the message ended; a field may still be waiting */
+func (s *Session) hdrfilter_finish() {
+	h := &s.hdrfilter
+	if h.state == 0 && len(h.field) > 0 {
+		s.hdrfilter_decide(true)
+	}
+	h.inheader = false
+}
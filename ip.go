@@ -1,13 +1,58 @@
 package main
 
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+/* IPv4 addresses are kept IPv4-mapped, ::ffff:a.b.c.d, like net.IP.To16 does */
+
 type ip_address struct {
-	d [4]byte
+	d [16]byte
+}
+
+var ip_v4prefix = [12]byte{10: 0xff, 11: 0xff}
+
+func ip_fromnet(nip net.IP) (ip_address, bool) {
+	var ip ip_address
+	nip = nip.To16()
+	if nip == nil {
+		return ip, false
+	}
+	copy(ip.d[:], nip)
+	return ip, true
+}
+
+func ip_isv4(ip ip_address) bool {
+	return [12]byte(ip.d[:12]) == ip_v4prefix
+}
+
+/* 4.3.2.1.zone, or a nibble per label for IPv6 (rfc 3596 2.5) */
+func ip_revname(ip ip_address, zone string) string {
+	var b strings.Builder
+	if ip_isv4(ip) {
+		for i := 15; i >= 12; i-- {
+			b.WriteString(strconv.Itoa(int(ip.d[i])))
+			b.WriteByte('.')
+		}
+	} else {
+		for i := 15; i >= 0; i-- {
+			b.WriteByte("0123456789abcdef"[ip.d[i]&15])
+			b.WriteByte('.')
+			b.WriteByte("0123456789abcdef"[ip.d[i]>>4])
+			b.WriteByte('.')
+		}
+	}
+	b.WriteString(zone)
+	return b.String()
 }
 
 func ip_scan(s string) (int, ip_address) {
 	var l int
 	var ip ip_address
 
+	copy(ip.d[:], ip_v4prefix[:])
 	for octet := 0; octet < 4; octet++ {
 		if octet > 0 {
 			if len(s) == 0 || s[0] != '.' {
@@ -21,7 +66,7 @@ func ip_scan(s string) (int, ip_address) {
 		if i == 0 {
 			return 0, ip
 		}
-		ip.d[octet] = byte(u)
+		ip.d[12+octet] = byte(u)
 		s = s[i:]
 		l += i
 	}
@@ -29,6 +74,29 @@ func ip_scan(s string) (int, ip_address) {
 	return l, ip
 }
 
+func ip6_scan(s string) (int, ip_address) {
+	var ip ip_address
+
+	l := 0
+	for l < len(s) && (ishex(s[l]) || s[l] == ':' || s[l] == '.') {
+		l++
+	}
+	if strings.IndexByte(s[:l], ':') == -1 {
+		return 0, ip
+	}
+	nip := net.ParseIP(s[:l])
+	if nip == nil {
+		return 0, ip
+	}
+	copy(ip.d[:], nip)
+	return l, ip
+}
+
+func ishex(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+/* [1.2.3.4] or [IPv6:2001:db8::1] (rfc 5321 4.1.3) */
 func ip_scanbracket(s string) (int, ip_address) {
 	var l int
 	var ip ip_address
@@ -36,11 +104,19 @@ func ip_scanbracket(s string) (int, ip_address) {
 	if len(s) == 0 || s[0] != '[' {
 		return 0, ip
 	}
-	l, ip = ip_scan(s[1:])
-	if l == 0 {
-		return 0, ip
+	if len(s) >= 6 && strings.EqualFold(s[1:6], "IPv6:") {
+		l, ip = ip6_scan(s[6:])
+		if l == 0 {
+			return 0, ip
+		}
+		l += 5
+	} else {
+		l, ip = ip_scan(s[1:])
+		if l == 0 {
+			return 0, ip
+		}
 	}
-	if l+1 > len(s) || s[l+1] != ']' {
+	if l+1 >= len(s) || s[l+1] != ']' {
 		return 0, ip
 	}
 
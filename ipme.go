@@ -23,9 +23,10 @@ func ipme_init() bool {
 		return false
 	}
 	for _, addr := range addrs {
-		n, ip := ip_scan(addr.String())
-		if n > 0 {
-			ipme = append(ipme, ip)
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			if ip, ok := ip_fromnet(ipnet.IP); ok {
+				ipme = append(ipme, ip)
+			}
 		}
 	}
 	ipmeok = true
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+/*
+ * With -listen we do the job of tcpserver ourselves: every connection
+ * gets a Session of its own, served in its own goroutine. Controls are
+ * read once at startup rather than for every connection. As with
+ * tcpserver -c, at most -c sessions run at a time; further connections
+ * wait to be accepted. A session that panics is logged and dropped
+ * without taking the others down.
+ *
+ * There are no tcprules to set RELAYCLIENT for some clients and not
+ * others, so RELAYCLIENT in our environment is ignored; clients relay by
+ * AUTH.
+ */
+
+var listenaddr string
+var listenlimit = 40
+
+func listen(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if listenlimit < 1 {
+		log.Fatal("-c must be at least 1")
+	}
+	sem := make(chan struct{}, listenlimit)
+	for {
+		sem <- struct{}{}
+		conn, err := ln.Accept()
+		if err != nil {
+			<-sem
+			log.Println(err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go func() {
+			defer func() { <-sem }()
+			serve(conn)
+		}()
+	}
+}
+
+func serve(conn net.Conn) {
+	var s Session
+	session_init(&s, conn, func(int) { runtime.Goexit() })
+	defer conn.Close()
+	defer qmail_abort(&s.qqt)
+	defer s.queue_reset()
+	defer func() {
+		if x := recover(); x != nil {
+			log.Printf("session %s: panic: %v\n%s", conn.RemoteAddr(), x, debug.Stack())
+		}
+	}()
+
+	if ra, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		s.remoteip = ra.IP.String()
+	}
+	if la, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		s.local = la.IP.String()
+	}
+	if r := s.proxy(); r == 0 {
+		if host := remotehost_lookup(s.remoteip); host != "" {
+			s.remotehost = host
+		}
+	}
+
+	s.smtp()
+}
+
+func remotehost_lookup(ip string) string {
+	ctx, cancel := dns_ctx()
+	defer cancel()
+	names, err := resolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+/*
+ * The lmtp backend hands messages to an LMTP server (rfc 2033), such as
+ * dovecot-lmtp, instead of queueing them. The first line of control/lmtp
+ * says where it listens: a path for a unix socket, or host:port.
+ *
+ *   /var/run/dovecot/lmtp
+ *   127.0.0.1:24
+ *
+ * The connection is opened at MAIL, and the client gets the server's own
+ * reply to MAIL and to each RCPT. After the message the server answers
+ * for each recipient once more. If the message got to some of them and
+ * not to others, the client is told 250 and the sender gets a bounce for
+ * the others; see queue_reply and queue_bounce.
+ */
+
+var lmtpnetwork string
+var lmtpaddress string
+
+func lmtp_init() int {
+	line, r := control_readline("control/lmtp")
+	if r != 1 {
+		return -1
+	}
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "":
+		return -1
+	case strings.HasPrefix(line, "/"):
+		lmtpnetwork = "unix"
+	default:
+		lmtpnetwork = "tcp"
+	}
+	lmtpaddress = line
+	return 0
+}
+
+type tLmtp struct {
+	tSpool
+	conn net.Conn
+	tc   *textproto.Conn
+	ext  string /* the reply to LHLO */
+	from string
+	to   []string
+}
+
+func lmtp_new() QueueBackend {
+	return &tLmtp{}
+}
+
+func (lm *tLmtp) Mail(from string, mp tMailParams) tQueueResult {
+	conn, err := net.DialTimeout(lmtpnetwork, lmtpaddress, timeout)
+	if err != nil {
+		return queue_temporary_result("4.4.1", "connection to LMTP server failed")
+	}
+	lm.conn = conn
+	lm.tc = textproto.NewConn(conn)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, _, err := lm.tc.ReadResponse(2); err != nil {
+		return queue_result(err, "LMTP server")
+	}
+	lm.ext, err = lmtp_cmd(lm.tc, 2, "LHLO %s", me)
+	if err != nil {
+		return queue_result(err, "LMTP server")
+	}
+	has := func(x string) bool { return lmtp_ext(lm.ext, x) }
+	if _, err := lmtp_cmd(lm.tc, 2, "MAIL FROM:<%s>%s", from, queue_mailparams(mp, has)); err != nil {
+		return queue_result(err, "LMTP server")
+	}
+	return tQueueResult{}
+}
+
+func (lm *tLmtp) Rcpt(to string, rd tRcptDsn) tQueueResult {
+	rcptparams := ""
+	if lmtp_ext(lm.ext, "DSN") {
+		rcptparams = dsn_rcptparams(rd)
+	}
+	lm.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := lmtp_cmd(lm.tc, 2, "RCPT TO:<%s>%s", to, rcptparams); err != nil {
+		return queue_result(err, "LMTP server")
+	}
+	return tQueueResult{}
+}
+
+/* the server took every recipient in to at RCPT */
+func (lm *tLmtp) Envelope(from string, to []string, dsn tEnvDsn) error {
+	lm.from = from
+	lm.to = to
+	return nil
+}
+
+func (lm *tLmtp) Commit() tQueueResult {
+	defer lm.Abort()
+	if lm.tc == nil {
+		return queue_temporary_result("4.3.0", "no LMTP transaction")
+	}
+
+	lm.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := lmtp_cmd(lm.tc, 3, "DATA"); err != nil {
+		return queue_result(err, "LMTP server")
+	}
+	if err := lm.rewind(); err != nil {
+		return queue_temporary_result("4.3.0", "unable to read spooled message")
+	}
+	dw := lm.tc.DotWriter() /* \n to \r\n, and the dots */
+	if _, err := io.Copy(dw, lm.spool); err != nil {
+		return queue_result(err, "LMTP server")
+	}
+	if err := dw.Close(); err != nil {
+		return queue_result(err, "LMTP server")
+	}
+
+	/* one reply for each recipient, in order */
+	qr := tQueueResult{rcpt: make([]tQueueResult, len(lm.to))}
+	delivered, failed := false, false
+	for i := range lm.to {
+		if _, _, err := lm.tc.ReadResponse(2); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				if !delivered {
+					return queue_result(err, "LMTP server")
+				}
+				/* too late to take back what was delivered */
+				for ; i < len(lm.to); i++ {
+					qr.rcpt[i] = queue_result(err, "LMTP server")
+				}
+				failed = true
+				break
+			}
+			qr.rcpt[i] = queue_result(err, "LMTP server")
+			failed = true
+			continue
+		}
+		delivered = true
+	}
+	if delivered && failed && lm.rewind() == nil {
+		queue_bounce(lm.from, lm.to, qr, lm.spool)
+	}
+	return qr
+}
+
+func (lm *tLmtp) Abort() {
+	if lm.tc != nil {
+		lm.conn.SetDeadline(time.Now().Add(timeout))
+		lm.tc.PrintfLine("QUIT")
+		lm.conn.Close()
+		lm.tc = nil
+	}
+	lm.tSpool.Abort()
+}
+
+/* sends a command, returns the text of the reply */
+func lmtp_cmd(tc *textproto.Conn, expect int, format string, args ...any) (string, error) {
+	if err := tc.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	_, msg, err := tc.ReadResponse(expect)
+	return msg, err
+}
+
+/* whether the reply to LHLO announces ext */
+func lmtp_ext(msg, ext string) bool {
+	for _, line := range strings.Split(msg, "\n") {
+		keyword, _, _ := strings.Cut(line, " ")
+		if strings.EqualFold(keyword, ext) {
+			return true
+		}
+	}
+	return false
+}
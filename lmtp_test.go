@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"qmail-smtpd/fakelmtp"
+)
+
+/* safe to read while the server writes */
+type tLockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (lb *tLockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.Write(p)
+}
+
+func (lb *tLockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.String()
+}
+
+/* points the lmtp backend at a fakelmtp server; returns what it delivers */
+func lmtp_fake(t *testing.T) *tLockedBuffer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	out := &tLockedBuffer{}
+	srv := &fakelmtp.Server{Out: out}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.Serve(conn)
+		}
+	}()
+
+	me = "test.local"
+	savednetwork, savedaddress := lmtpnetwork, lmtpaddress
+	lmtpnetwork, lmtpaddress = "tcp", ln.Addr().String()
+	t.Cleanup(func() { lmtpnetwork, lmtpaddress = savednetwork, savedaddress })
+	return out
+}
+
+/* bin/qmail-queue for bounces: keeps the message and envelope in dir */
+func lmtp_fakeqq(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	savedqmail, savedargs := auto_qmail, binqqargs
+	auto_qmail = dir
+	binqqargs = []string{"/bin/sh", "-c", "cat > msg; cat <&1 > env"}
+	t.Cleanup(func() { auto_qmail, binqqargs = savedqmail, savedargs })
+	return dir
+}
+
+func TestLmtpSession(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		to     []string
+		rcpt   []int /* reply to each RCPT */
+		data   int
+		ecode  string /* of the reply to the message, if it failed */
+		got    []string
+		bounce string /* who is listed in the bounce, if any */
+	}{
+		{"all", []string{"ann", "bob"}, []int{250, 250}, 250, "", []string{"ann", "bob"}, ""},
+		{"refuse", []string{"ann", "refuse"}, []int{250, 550}, 250, "", []string{"ann"}, ""},
+		{"defer", []string{"defer", "ann"}, []int{450, 250}, 250, "", []string{"ann"}, ""},
+		{"fail", []string{"ann", "fail"}, []int{250, 250}, 250, "", []string{"ann"}, "fail"},
+		{"later", []string{"later", "ann"}, []int{250, 250}, 250, "", []string{"ann"}, "later"},
+		{"nobody", []string{"fail", "later"}, []int{250, 250}, 451, "4.2.2", nil, ""},
+		{"full", []string{"fail"}, []int{250}, 554, "5.2.2", nil, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out := lmtp_fake(t)
+			qqdir := lmtp_fakeqq(t)
+			tc, done := session_pipe(t, lmtp_new())
+
+			expect(t, tc, 220, "")
+			expect(t, tc, 250, "HELO client.example")
+			expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+			for i, it := range tt.to {
+				expect(t, tc, tt.rcpt[i], "RCPT TO:<"+it+"@test.local>")
+			}
+			expect(t, tc, 354, "DATA")
+			dw := tc.DotWriter()
+			dw.Write([]byte("Subject: test\n\nhello\n"))
+			dw.Close()
+			msg := expect(t, tc, tt.data, "")
+			if tt.ecode != "" && !strings.HasPrefix(msg, tt.ecode+" ") {
+				t.Errorf("DATA: got %q, want %s", msg, tt.ecode)
+			}
+			expect(t, tc, 221, "QUIT")
+			<-done
+
+			var got []string
+			for _, line := range strings.Split(out.String(), "\n") {
+				if _, to, ok := strings.Cut(line, " RCPT TO:"); ok {
+					got = append(got, strings.TrimSuffix(strings.Trim(to, "<>"), "@test.local"))
+				}
+			}
+			if strings.Join(got, " ") != strings.Join(tt.got, " ") {
+				t.Errorf("delivered to %q, want %q", got, tt.got)
+			}
+
+			bounce, err := os.ReadFile(filepath.Join(qqdir, "msg"))
+			switch {
+			case tt.bounce == "" && err == nil:
+				t.Errorf("unexpected bounce: %q", bounce)
+			case tt.bounce == "":
+			case err != nil:
+				t.Errorf("no bounce: %v", err)
+			default:
+				if !strings.Contains(string(bounce), "<"+tt.bounce+"@test.local>:\n") ||
+					!strings.HasSuffix(string(bounce), "Subject: test\n\nhello\n") {
+					t.Errorf("bounce: got %q", bounce)
+				}
+				env, _ := os.ReadFile(filepath.Join(qqdir, "env"))
+				if string(env) != "F\x00Tjoe@example.com\x00\x00" {
+					t.Errorf("bounce envelope: got %q", env)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+/* no flock here: concurrent updates of one key may get lost */
+func lock_ex(fd *os.File) error {
+	return nil
+}
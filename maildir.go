@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The maildir backend delivers straight into Maildirs, without qmail-send.
+ * control/maildirmap says which Maildir each recipient gets, one per line:
+ *
+ *   joe@example.com:/home/joe/Maildir
+ *   @example.net:/var/mail/example.net
+ *
+ * @domain takes everything at that domain that has no line of its own.
+ * Relative paths are taken from the qmail directory. The Maildirs have to
+ * exist already. A recipient that is not listed is refused at RCPT, so
+ * every message that gets as far as Commit can be delivered to all of
+ * its recipients; should one not be, nobody gets it and the message is
+ * refused as a whole.
+ *
+ * Every copy gets Return-Path and Delivered-To, as from qmail-local. All
+ * copies are written to tmp first and moved to new only when all of them
+ * have been written.
+ */
+
+var maildirmap = map[string]string{}
+var maildirhost string
+var maildirseq atomic.Uint64
+
+func maildir_init() int {
+	ss, r := control_readfile("control/maildirmap", false)
+	if r != 1 {
+		return -1
+	}
+	for _, line := range ss {
+		addr, dir, ok := strings.Cut(line, ":")
+		if !ok || addr == "" || dir == "" {
+			return -1
+		}
+		maildirmap[vrt_norm(addr)] = dir
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	host = strings.ReplaceAll(host, "/", "\\057")
+	host = strings.ReplaceAll(host, ":", "\\072")
+	maildirhost = host
+	return 0
+}
+
+func maildir_lookup(addr string) (string, bool) {
+	addr = vrt_norm(addr)
+	if dir, ok := maildirmap[addr]; ok {
+		return dir, true
+	}
+	if strings.IndexByte(addr, '@') == -1 {
+		return "", false
+	}
+	dir, ok := maildirmap["@"+vrt_domain(addr)]
+	return dir, ok
+}
+
+/* time.MusecPpidQseq.host, unique as long as the clock does not go back */
+func maildir_uniq() string {
+	now := time.Now()
+	return strconv.FormatInt(now.Unix(), 10) +
+		".M" + strconv.Itoa(now.Nanosecond()/1000) +
+		"P" + strconv.Itoa(os.Getpid()) +
+		"Q" + strconv.FormatUint(maildirseq.Add(1), 10) +
+		"." + maildirhost
+}
+
+type tMaildir struct {
+	tSpool
+	from string
+	to   []string
+}
+
+func maildir_new() QueueBackend {
+	return &tMaildir{}
+}
+
+func (md *tMaildir) Mail(from string, mp tMailParams) tQueueResult {
+	return tQueueResult{}
+}
+
+func (md *tMaildir) Rcpt(to string, dsn tRcptDsn) tQueueResult {
+	if _, ok := maildir_lookup(to); !ok {
+		return tQueueResult{status: queue_permanent, code: 550, ecode: "5.1.1", text: "sorry, no mailbox here by that name"}
+	}
+	return tQueueResult{}
+}
+
+func (md *tMaildir) Envelope(from string, to []string, dsn tEnvDsn) error {
+	md.from = from
+	md.to = to
+	return nil
+}
+
+/* one copy in dir/tmp; returns its name there */
+func (md *tMaildir) deliver(dir, rcpt string) (string, error) {
+	fn := filepath.Join(dir, "tmp", maildir_uniq())
+	fd, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			fd.Close()
+			os.Remove(fn)
+		}
+	}()
+
+	if err := md.rewind(); err != nil {
+		return "", err
+	}
+	ss := bufio.NewWriter(fd)
+	ss.WriteString("Return-Path: <" + md.from + ">\n")
+	ss.WriteString("Delivered-To: " + rcpt + "\n")
+	if _, err := io.Copy(ss, md.spool); err != nil {
+		return "", err
+	}
+	if err := ss.Flush(); err != nil {
+		return "", err
+	}
+	if err := fd.Sync(); err != nil {
+		return "", err
+	}
+	if err := fd.Close(); err != nil {
+		return "", err
+	}
+	ok = true
+	return fn, nil
+}
+
+func (md *tMaildir) Commit() tQueueResult {
+	defer md.Abort()
+
+	dirs := make([]string, len(md.to))
+	for i, it := range md.to {
+		dir, ok := maildir_lookup(it)
+		if !ok {
+			return queue_permanent_result("5.1.1", "no mailbox here for "+it)
+		}
+		dirs[i] = dir
+	}
+
+	var tmps []string
+	for i, it := range md.to {
+		fn, err := md.deliver(dirs[i], it)
+		if err != nil {
+			for _, it := range tmps {
+				os.Remove(it)
+			}
+			return queue_temporary_result("4.3.0", "unable to write to maildir")
+		}
+		tmps = append(tmps, fn)
+	}
+
+	for i, it := range tmps {
+		if err := os.Rename(it, filepath.Join(dirs[i], "new", filepath.Base(it))); err != nil {
+			for _, it := range tmps[i:] {
+				os.Remove(it)
+			}
+			/* copies already in new are delivered again on retry; better than lost */
+			return queue_temporary_result("4.3.0", "unable to write to maildir")
+		}
+	}
+	return tQueueResult{}
+}
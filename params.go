@@ -0,0 +1,181 @@
+package main
+
+import "strings"
+
+/* esmtp-param = esmtp-keyword ["=" esmtp-value] (rfc 5321 4.1.2) */
+
+type tParams map[string]string
+
+type tParam struct {
+	keyword string
+	fun     func(*Session, string) int /* 0 if it has already complained */
+}
+
+func (s *Session) err_param()      { s.reply_out(reply(555, "5.5.4", "unsupported parameter")) }
+func (s *Session) err_paramvalue() { s.reply_out(reply(501, "5.5.4", "syntax error in parameters")) }
+
+func iskeyword(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, ch := range []byte(s) {
+		switch {
+		case ch >= 'a' && ch <= 'z':
+		case ch >= 'A' && ch <= 'Z':
+		case ch >= '0' && ch <= '9':
+		case ch == '-' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isvalue(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, ch := range []byte(s) {
+		if ch < 33 || ch > 126 || ch == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func paramparse(s string) (tParams, int) {
+	p := tParams{}
+	for _, it := range strings.Fields(s) {
+		keyword, value, hasvalue := strings.Cut(it, "=")
+		if !iskeyword(keyword) {
+			return nil, 0
+		}
+		if hasvalue && !isvalue(value) {
+			return nil, 0
+		}
+		keyword = strings.ToUpper(keyword)
+		if _, ok := p[keyword]; ok {
+			return nil, 0
+		}
+		p[keyword] = value
+	}
+	return p, 1
+}
+
+func (s *Session) paramdispatch(p tParams, t []tParam) int {
+	for keyword := range p {
+		i := 0
+		for ; i < len(t); i++ {
+			if t[i].keyword == keyword {
+				break
+			}
+		}
+		if i == len(t) {
+			s.err_param()
+			return 0
+		}
+	}
+	for i := range t {
+		if value, ok := p[t[i].keyword]; ok {
+			if t[i].fun(s, value) == 0 {
+				return 0
+			}
+		}
+	}
+	return 1
+}
+
+/* xtext = *( xchar / hexchar ) (rfc 3461 4) */
+
+func xtext_decode(s string) (string, bool) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch < 33 || ch > 126 || ch == '=' {
+			return "", false
+		}
+		if ch == '+' {
+			if i+2 >= len(s) || !ishexupper(s[i+1]) || !ishexupper(s[i+2]) {
+				return "", false
+			}
+			ch = unhex(s[i+1])<<4 | unhex(s[i+2])
+			i += 2
+		}
+		b = append(b, ch)
+	}
+	return string(b), true
+}
+
+func ishexupper(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'A' && ch <= 'F')
+}
+
+func unhex(ch byte) byte {
+	if ch <= '9' {
+		return ch - '0'
+	}
+	return ch - 'A' + 10
+}
+
+var mailparams = []tParam{
+	{"SIZE", (*Session).param_size},
+	{"BODY", (*Session).param_body},
+	{"SMTPUTF8", (*Session).param_smtputf8},
+	{"RET", (*Session).param_ret},
+	{"ENVID", (*Session).param_envid},
+	{"AUTH", (*Session).param_auth},
+}
+
+var rcptparams = []tParam{
+	{"NOTIFY", (*Session).param_notify},
+	{"ORCPT", (*Session).param_orcpt},
+}
+
+/* SIZE=nnn (rfc 1870) */
+func (s *Session) param_size(value string) int {
+	i, u := scan_ulong(value)
+	if i == 0 || i != len(value) {
+		s.err_paramvalue()
+		return 0
+	}
+	if i > 18 { /* would overflow, and is way too big anyway */
+		u = ^uint(0)
+	}
+	if databytes > 0 && u > uint(databytes) {
+		s.err_size()
+		return 0
+	}
+	s.mailsize = u
+	return 1
+}
+
+/* BODY=7BIT|8BITMIME (rfc 6152) */
+func (s *Session) param_body(value string) int {
+	value = strings.ToUpper(value)
+	switch value {
+	case "7BIT", "8BITMIME":
+		s.mailbody = value
+		return 1
+	}
+	s.err_paramvalue()
+	return 0
+}
+
+/* AUTH=<mailbox> (rfc 4954 5); we keep no use for it, but it must be well-formed */
+func (s *Session) param_auth(value string) int {
+	if _, ok := xtext_decode(value); !ok {
+		s.err_paramvalue()
+		return 0
+	}
+	return 1
+}
+
+/* SMTPUTF8 (rfc 6531) */
+func (s *Session) param_smtputf8(value string) int {
+	if value != "" {
+		s.err_paramvalue()
+		return 0
+	}
+	s.flagutf8 = true
+	return 1
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+)
+
+/*
+ * PROXY protocol, v1 and v2 (haproxy proxy-protocol.txt).
+ *
+ * Connections from an address listed in control/proxyips must start with
+ * a PROXY header, which tells us the real remoteip and local. Connections
+ * from anywhere else are taken as they are. When the header gives
+ * addresses, remotehost is looked up again, and RELAYCLIENT and
+ * TCPREMOTEINFO, which were meant for the proxy, are dropped; clients
+ * behind it relay by AUTH. A header without addresses (v1 UNKNOWN, v2
+ * LOCAL or AF_UNSPEC) leaves the connection as it is.
+ */
+
+var proxyok bool
+var mapproxy = tConstmap{}
+
+var proxy_v2sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+/* the same address may be written in more than one way */
+func proxy_ipnorm(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
+
+func proxy_init() int {
+	ss, r := control_readfile("control/proxyips", false)
+	if r != 1 {
+		return r
+	}
+	for i := range ss {
+		ss[i] = proxy_ipnorm(ss[i])
+	}
+	constmap_init(mapproxy, ss)
+	proxyok = true
+	return 0
+}
+
+func (s *Session) die_proxy() {
+	s.reply_out(reply(421, "4.3.0", "unable to read PROXY header"))
+	s.flush()
+	s._exit(1)
+}
+
+/* PROXY TCP4 192.0.2.1 192.0.2.2 56324 25\r\n; 1 if it gave addresses */
+func (s *Session) proxy_v1() int {
+	line, err := s.ssin.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		s.die_proxy()
+	}
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return 0
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		s.die_proxy()
+	}
+	src := net.ParseIP(f[2])
+	dst := net.ParseIP(f[3])
+	if src == nil || dst == nil {
+		s.die_proxy()
+	}
+	/* TCP4 wants dotted quads, TCP6 wants colons */
+	v6 := f[1] == "TCP6"
+	if strings.Contains(f[2], ":") != v6 || strings.Contains(f[3], ":") != v6 {
+		s.die_proxy()
+	}
+	s.remoteip = src.String()
+	s.local = dst.String()
+	return 1
+}
+
+/* 1 if it gave addresses */
+func (s *Session) proxy_v2() int {
+	var hdr [16]byte
+	if _, err := io.ReadFull(s.ssin, hdr[:]); err != nil {
+		s.die_read()
+	}
+	if hdr[12]>>4 != 2 {
+		s.die_proxy()
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(s.ssin, body); err != nil {
+		s.die_read()
+	}
+
+	switch hdr[12] & 15 {
+	case 0: /* LOCAL: health check from the proxy itself */
+		return 0
+	case 1: /* PROXY */
+	default:
+		s.die_proxy()
+	}
+
+	var n int
+	switch hdr[13] >> 4 {
+	case 1:
+		n = 4
+	case 2:
+		n = 16
+	default: /* AF_UNSPEC, AF_UNIX */
+		return 0
+	}
+	if len(body) < 2*n+4 {
+		s.die_proxy()
+	}
+	s.remoteip = net.IP(body[:n]).String()
+	s.local = net.IP(body[n : 2*n]).String()
+	return 1
+}
+
+/*
+ * before smtp_greet: replace remoteip and local if a trusted proxy says
+ * so; 1 if they were replaced
+ */
+func (s *Session) proxy() int {
+	if !proxyok || !constmap(mapproxy, proxy_ipnorm(s.remoteip)) {
+		return 0
+	}
+
+	sig, err := s.ssin.Peek(len(proxy_v2sig))
+	if err != nil {
+		s.die_read()
+	}
+	var r int
+	switch {
+	case bytes.Equal(sig, proxy_v2sig):
+		r = s.proxy_v2()
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		r = s.proxy_v1()
+	default:
+		s.die_proxy()
+	}
+	if r == 0 {
+		return 0
+	}
+
+	s.remotehost = "unknown"
+	if host := remotehost_lookup(s.remoteip); host != "" {
+		s.remotehost = host
+	}
+	s.remoteinfo = ""
+	s.relayclient = ""
+	s.relayclientok = false
+	return 1
+}
@@ -0,0 +1,17 @@
+package main
+
+import "qmail-smtpd/punycode"
+
+func isascii(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+/* lowercased, with every U-label replaced by its A-label */
+func domain_toascii(s string) string {
+	return punycode.ToASCII(s)
+}
@@ -0,0 +1,123 @@
+// Package punycode is punycode (rfc 3492), just enough to turn U-labels
+// into A-labels. It is shared by qmail-smtpd and the programs that
+// compile its control files.
+package punycode
+
+import "strings"
+
+const (
+	puny_base        = 36
+	puny_tmin        = 1
+	puny_tmax        = 26
+	puny_skew        = 38
+	puny_damp        = 700
+	puny_initialbias = 72
+	puny_initialn    = 128
+)
+
+func puny_adapt(delta, numpoints int, firsttime bool) int {
+	if firsttime {
+		delta /= puny_damp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numpoints
+	k := 0
+	for delta > ((puny_base-puny_tmin)*puny_tmax)/2 {
+		delta /= puny_base - puny_tmin
+		k += puny_base
+	}
+	return k + (puny_base-puny_tmin+1)*delta/(delta+puny_skew)
+}
+
+func puny_digit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// Encode is the punycode of s, without the "xn--".
+func Encode(s string) string {
+	runes := []rune(s)
+
+	var out []byte
+	for _, r := range runes {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+
+	n := puny_initialn
+	delta := 0
+	bias := puny_initialbias
+	for h < len(runes) {
+		m := int(^uint(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := puny_base; ; k += puny_base {
+				t := k - bias
+				if t < puny_tmin {
+					t = puny_tmin
+				} else if t > puny_tmax {
+					t = puny_tmax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, puny_digit(t+(q-t)%(puny_base-t)))
+				q = (q - t) / (puny_base - t)
+			}
+			out = append(out, puny_digit(q))
+			bias = puny_adapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func isascii(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// ToASCII is the domain s lowercased, with every U-label replaced by its
+// A-label.
+func ToASCII(s string) string {
+	s = strings.ToLower(s)
+	if isascii(s) {
+		return s
+	}
+	labels := strings.Split(s, ".")
+	for i := range labels {
+		if !isascii(labels[i]) {
+			labels[i] = "xn--" + Encode(labels[i])
+		}
+	}
+	return strings.Join(labels, ".")
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
+	"flag"
 	"log"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 const MAXHOPS = 100
@@ -16,92 +17,119 @@ const MAXHOPS = 100
 var databytes = 0
 var timeout = 1200 * time.Second // WTF: why so many?
 
-type safeWriter os.File
+type safeWriter struct{ s *Session }
 
-func (r *safeWriter) Write(b []byte) (n int, err error) {
-	// we will be died when the timeout expires, so there is no point in buffering the channel
-	done := make(chan struct{})
-	go func() {
-		n, err = (*os.File)(r).Write(b)
-		done <- struct{}{}
-	}()
+func (w safeWriter) Write(b []byte) (n int, err error) {
+	w.s.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if w.s.ssl != nil {
+		n, err = w.s.ssl.Write(b)
+	} else {
+		n, err = w.s.conn.Write(b)
+	}
+	if err != nil {
+		w.s._exit(1)
+	}
+	return n, err
+}
+
+type safeReader struct{ s *Session }
 
-	tm := time.NewTimer(timeout)
-	select {
-	case <-tm.C:
-		_exit(1)
-		return 0, errors.New("write timeout") // _exit never returns so this will never happen
-	case <-done:
-		tm.Stop()
-		return n, err
+func (r safeReader) Read(b []byte) (n int, err error) {
+	r.s.flush()
+	r.s.conn.SetReadDeadline(time.Now().Add(timeout))
+	if r.s.ssl != nil {
+		n, err = r.s.ssl.Read(b)
+	} else {
+		n, err = r.s.conn.Read(b)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		r.s.die_alarm()
 	}
+	return n, err
 }
 
-var ssout = bufio.NewWriter((*safeWriter)(os.Stdout))
+func (s *Session) _exit(code int) { s.exit(code) }
 
-func flush() {
-	if err := ssout.Flush(); err != nil {
-		log.Fatal(err)
+func (s *Session) flush() {
+	if err := s.ssout.Flush(); err != nil {
+		s._exit(1)
 	}
 }
 
-func out(s string) {
-	if _, err := ssout.WriteString(s); err != nil {
-		log.Fatal(err)
+func (s *Session) out(str string) {
+	if _, err := s.ssout.WriteString(str); err != nil {
+		s._exit(1)
 	}
 }
 
-func die_read()     { _exit(1) }
-func die_alarm()    { out("451 timeout (#4.4.2)\r\n"); flush(); _exit(1) }
-func die_nomem()    { out("421 out of memory (#4.3.0)\r\n"); flush(); _exit(1) }
-func die_control()  { out("421 unable to read controls (#4.3.0)\r\n"); flush(); _exit(1) }
-func die_ipme()     { out("421 unable to figure out my IP addresses (#4.3.0)\r\n"); flush(); _exit(1) }
-func straynewline() { out("451 See http://pobox.com/~djb/docs/smtplf.html.\r\n"); flush(); _exit(1) }
+func (s *Session) reply_out(r tReply) {
+	s.out(reply_fmt(r))
+}
 
-func err_bmf() { out("553 sorry, your envelope sender is in my badmailfrom list (#5.7.1)\r\n") }
-func err_nogateway() {
-	out("553 sorry, that domain isn't in my list of allowed rcpthosts (#5.7.1)\r\n")
+func (s *Session) die_read()  { s._exit(1) }
+func (s *Session) die_alarm() { s.reply_out(reply(451, "4.4.2", "timeout")); s.flush(); s._exit(1) }
+func (s *Session) die_nomem() {
+	s.reply_out(reply(421, "4.3.0", "out of memory"))
+	s.flush()
+	s._exit(1)
+}
+func (s *Session) die_control() {
+	s.reply_out(reply(421, "4.3.0", "unable to read controls"))
+	s.flush()
+	s._exit(1)
+}
+func (s *Session) die_ipme() {
+	s.reply_out(reply(421, "4.3.0", "unable to figure out my IP addresses"))
+	s.flush()
+	s._exit(1)
+}
+func (s *Session) straynewline() {
+	s.reply_out(reply(451, "4.6.0", "See http://pobox.com/~djb/docs/smtplf.html."))
+	s.flush()
+	s._exit(1)
+}
+
+func (s *Session) err_bmf() {
+	s.reply_out(reply(553, "5.7.1", "sorry, your envelope sender is in my badmailfrom list"))
+}
+func (s *Session) err_nogateway() {
+	s.reply_out(reply(553, "5.7.1", "sorry, that domain isn't in my list of allowed rcpthosts"))
+}
+func (s *Session) err_unimpl()   { s.reply_out(reply(502, "5.5.1", "unimplemented")) }
+func (s *Session) err_syntax()   { s.reply_out(reply(555, "5.5.4", "syntax error")) }
+func (s *Session) err_wantmail() { s.reply_out(reply(503, "5.5.1", "MAIL first")) }
+func (s *Session) err_wantrcpt() { s.reply_out(reply(503, "5.5.1", "RCPT first")) }
+func (s *Session) err_noop()     { s.reply_out(reply(250, "2.0.0", "ok")) }
+func (s *Session) err_vrfy()     { s.reply_out(reply(252, "2.1.5", "send some mail, i'll try my best")) }
+func (s *Session) err_qqt()      { s.reply_out(reply(451, "4.3.0", "qqt failure")) }
+func (s *Session) err_utf8() {
+	s.reply_out(reply(553, "5.6.7", "sorry, non-ASCII addresses require SMTPUTF8"))
+}
+func (s *Session) err_size() {
+	s.reply_out(reply(552, "5.3.4", "sorry, that message size exceeds my databytes limit"))
 }
-func err_unimpl()   { out("502 unimplemented (#5.5.1)\r\n") }
-func err_syntax()   { out("555 syntax error (#5.5.4)\r\n") }
-func err_wantmail() { out("503 MAIL first (#5.5.1)\r\n") }
-func err_wantrcpt() { out("503 RCPT first (#5.5.1)\r\n") }
-func err_noop()     { out("250 ok\r\n") }
-func err_vrfy()     { out("252 send some mail, i'll try my best\r\n") }
-func err_qqt()      { out("451 qqt failure (#4.3.0)\r\n") }
 
 var greeting string
 
-func smtp_greet(code string) {
-	out(code)
-	out(greeting)
+func (s *Session) smtp_greet() {
+	s.reply_out(reply(220, "", greeting+" ESMTP"))
 }
 
-func smtp_help(_ string) {
-	out("214 qmail home page: http://pobox.com/~djb/qmail.html\r\n")
+func (s *Session) smtp_help(_ string) {
+	s.reply_out(reply(214, "2.0.0", "qmail home page: http://pobox.com/~djb/qmail.html"))
 }
 
-func smtp_quit(_ string) {
-	smtp_greet("221 ")
-	out("\r\n")
-	flush()
-	_exit(0)
+func (s *Session) smtp_quit(_ string) {
+	s.queue_reset()
+	s.reply_out(reply(221, "2.0.0", greeting))
+	s.flush()
+	s._exit(0)
 }
 
-var remoteip string
-var remotehost string
-var remoteinfo string
-var local string
-var relayclient string
-var relayclientok bool
-
-var helohost string
-var fakehelo string /* pointer into helohost, or 0 */
-
-func dohelo(arg string) {
-	helohost = arg
-	if case_diffs(remotehost, helohost) {
-		fakehelo = helohost
+func (s *Session) dohelo(arg string) {
+	s.helohost = arg
+	if case_diffs(s.remotehost, s.helohost) {
+		s.fakehelo = s.helohost
 	}
 }
 
@@ -110,26 +138,26 @@ var liphost string
 var bmfok bool
 var mapbmf = tConstmap{}
 
-func setup() {
+func setup() int {
 	if control_init() == -1 {
-		die_control()
+		return -1
 	}
 
 	if s, r := control_rldef("control/smtpgreeting", true, ""); r != 1 {
-		die_control()
+		return -1
 	} else {
 		greeting = s
 	}
 
 	if s, r := control_rldef("control/localiphost", true, ""); r == -1 {
-		die_control()
+		return -1
 	} else if r == 1 {
 		liphost = s
 		liphostok = true
 	}
 
 	if i, r := control_readint("control/timeoutsmtpd"); r == -1 {
-		die_control()
+		return -1
 	} else if r == 1 {
 		if i <= 0 {
 			i = 1
@@ -137,19 +165,63 @@ func setup() {
 		timeout = time.Duration(i) * time.Second
 	}
 
+	if tls_init() == -1 {
+		return -1
+	}
+
 	if rcpthosts_init() == -1 {
-		die_control()
+		return -1
+	}
+
+	if proxy_init() == -1 {
+		return -1
+	}
+
+	if dns_init() == -1 {
+		return -1
+	}
+
+	if dnsbl_init() == -1 {
+		return -1
+	}
+
+	if spf_init() == -1 {
+		return -1
+	}
+
+	if dkim_init() == -1 {
+		return -1
+	}
+
+	if greylist_init() == -1 {
+		return -1
+	}
+
+	if ratelimit_init() == -1 {
+		return -1
+	}
+
+	if vrt_init() == -1 {
+		return -1
+	}
+
+	if rcptcheck_init() == -1 {
+		return -1
+	}
+
+	if queue_init() == -1 {
+		return -1
 	}
 
 	if ss, r := control_readfile("control/badmailfrom", false); r == -1 {
-		die_control()
+		return -1
 	} else if r == 1 {
 		constmap_init(mapbmf, ss)
 		bmfok = true
 	}
 
 	if i, r := control_readint("control/databytes"); r == -1 {
-		die_control()
+		return -1
 	} else if r == 1 {
 		databytes = i
 	}
@@ -167,33 +239,10 @@ func setup() {
 		databytes--
 	}
 
-	remoteip = os.Getenv("TCPREMOTEIP")
-	if remoteip == "" {
-		remoteip = "unknown"
-	}
-
-	local = os.Getenv("TCPLOCALHOST")
-	if local == "" {
-		local = os.Getenv("TCPLOCALIP")
-	}
-	if local == "" {
-		local = "unknown"
-	}
-
-	remotehost = os.Getenv("TCPREMOTEHOST")
-	if remotehost == "" {
-		remotehost = "unknown"
-	}
-
-	remoteinfo = os.Getenv("TCPREMOTEINFO")
-	relayclient, relayclientok = os.LookupEnv("RELAYCLIENT")
-
-	dohelo(remotehost)
+	return 0
 }
 
-var addr string
-
-func addrparse(arg string) int {
+func (s *Session) addrparse(arg string) int {
 	terminator := '>'
 
 	if i := strings.IndexByte(arg, '<'); i != -1 {
@@ -219,12 +268,14 @@ func addrparse(arg string) int {
 	var flagesc bool
 	var flagquoted bool
 
-	for _, ch := range []byte(arg) { /* copy arg to addr, stripping quotes */
+	end := -1
+	for i, ch := range []byte(arg) { /* copy arg to addr, stripping quotes */
 		if flagesc {
 			addrbuf = append(addrbuf, ch)
 			flagesc = false
 		} else {
 			if !flagquoted && ch == byte(terminator) {
+				end = i
 				break
 			}
 			switch ch {
@@ -237,7 +288,16 @@ func addrparse(arg string) int {
 			}
 		}
 	}
-	/* could check for termination failure here, but why bother? */
+	if end == -1 && terminator == '>' {
+		return 0
+	}
+
+	var r int
+	if end == -1 {
+		s.param = tParams{}
+	} else if s.param, r = paramparse(arg[end+1:]); r == 0 {
+		return 0
+	}
 
 	if liphostok {
 		i := bytes.LastIndexByte(addrbuf, '@')
@@ -256,181 +316,248 @@ func addrparse(arg string) int {
 	if len(addrbuf) > 900 {
 		return 0
 	}
+	if !utf8.Valid(addrbuf) {
+		return 0
+	}
 
-	addr = string(addrbuf)
+	s.addr = string(addrbuf)
 	return 1
 }
 
-func bmfcheck() bool {
+func (s *Session) bmfcheck() bool {
 	if !bmfok {
 		return false
 	}
-	if constmap(mapbmf, addr) {
+	if constmap(mapbmf, s.addr) {
 		return true
 	}
-	if j := strings.IndexByte(addr, '@'); j != -1 {
-		if constmap(mapbmf, addr[j+1:]) {
+	if j := strings.IndexByte(s.addr, '@'); j != -1 {
+		if constmap(mapbmf, s.addr[j+1:]) {
 			return true
 		}
 	}
 	return false
 }
 
-func addrallowed() bool {
-	r := rcpthosts(addr)
+func (s *Session) addrallowed() bool {
+	r := rcpthosts(s.addr)
 	if r == -1 {
-		die_control()
+		s.die_control()
 	}
 	return r != 0
 }
 
-var seenmail bool
-var flagbarf bool /* defined if seenmail */
-var mailfrom string
-var rcptto []string
-
-func smtp_helo(arg string) {
-	smtp_greet("250 ")
-	out("\r\n")
-	seenmail = false
-	dohelo(arg)
+func (s *Session) smtp_helo(arg string) {
+	s.bdat_abort()
+	s.reply_out(reply(250, "", greeting))
+	s.queue_reset()
+	s.seenmail = false
+	s.dohelo(arg)
 }
 
-func smtp_ehlo(arg string) {
-	smtp_greet("250-")
-	out("\r\n250-PIPELINING\r\n250 8BITMIME\r\n")
-	seenmail = false
-	dohelo(arg)
+func (s *Session) smtp_ehlo(arg string) {
+	s.bdat_abort()
+	ext := []string{greeting, "PIPELINING", "ENHANCEDSTATUSCODES"}
+	if servercertok && s.ssl == nil {
+		ext = append(ext, "STARTTLS")
+	}
+	if len(childargs) > 0 {
+		ext = append(ext, s.authmechs())
+	}
+	if databytes > 0 {
+		ext = append(ext, "SIZE "+strconv.Itoa(databytes))
+	} else {
+		ext = append(ext, "SIZE")
+	}
+	ext = append(ext, "SMTPUTF8", "CHUNKING", "DSN", "8BITMIME")
+	s.reply_out(reply(250, "", ext...))
+	s.queue_reset()
+	s.seenmail = false
+	s.dohelo(arg)
 }
 
-func smtp_rset(args string) {
-	seenmail = false
-	out("250 flushed\r\n")
+func (s *Session) smtp_rset(args string) {
+	s.bdat_abort()
+	s.queue_reset()
+	s.seenmail = false
+	s.reply_out(reply(250, "2.0.0", "flushed"))
 }
 
-func smtp_mail(arg string) {
-	if r := addrparse(arg); r == 0 {
-		err_syntax()
+func (s *Session) smtp_mail(arg string) {
+	s.bdat_abort()
+	s.queue_reset()
+	if r := s.addrparse(arg); r == 0 {
+		s.err_syntax()
+		return
+	}
+	s.mailsize = 0
+	s.mailbody = ""
+	s.flagutf8 = false
+	s.dsnret = ""
+	s.dsnenvid = ""
+	if r := s.paramdispatch(s.param, mailparams); r == 0 {
+		return
+	}
+	if !s.flagutf8 && !isascii(s.addr) {
+		s.err_utf8()
 		return
 	}
-	flagbarf = bmfcheck()
-	seenmail = true
-	rcptto = rcptto[:0]
-	mailfrom = addr
-	out("250 ok\r\n")
+	s.flagbarf = s.bmfcheck()
+	s.mailfrom = s.addr
+	if r := s.spf_check(); r == 0 {
+		s.seenmail = false
+		return
+	}
+	if r := ratelimit("messages", s.ratelimit_who(), false); r == 0 {
+		s.seenmail = false
+		s.err_ratelimit("messages")
+		return
+	}
+	if r := s.queue_mail(); r == 0 {
+		s.seenmail = false
+		return
+	}
+	s.seenmail = true
+	s.rcptto = s.rcptto[:0]
+	s.rcptdsn = s.rcptdsn[:0]
+	s.reply_out(reply(250, "2.1.0", "ok"))
 }
 
-func smtp_rcpt(arg string) {
-	if !seenmail {
-		err_wantmail()
+func (s *Session) smtp_rcpt(arg string) {
+	if !s.seenmail {
+		s.err_wantmail()
+		return
+	}
+	if r := s.addrparse(arg); r == 0 {
+		s.err_syntax()
 		return
 	}
-	if r := addrparse(arg); r == 0 {
-		err_syntax()
+	s.dsnnotify = ""
+	s.dsnorcpt = ""
+	if r := s.paramdispatch(s.param, rcptparams); r == 0 {
 		return
 	}
-	if flagbarf {
-		err_bmf()
+	if !s.flagutf8 && !isascii(s.addr) {
+		s.err_utf8()
 		return
 	}
-	if relayclientok {
-		addr += relayclient
+	if s.flagbarf {
+		s.err_bmf()
+		return
+	}
+	if s.dnsblreply.code != 0 && !s.relayclientok {
+		s.reply_out(s.dnsblreply)
+		return
+	}
+	if s.relayclientok {
+		s.addr += s.relayclient
 	} else {
-		if !addrallowed() {
-			err_nogateway()
+		if !s.addrallowed() {
+			s.err_nogateway()
+			return
+		}
+		if !s.addrvalid() {
+			s.err_vrt()
 			return
 		}
 	}
-	rcptto = append(rcptto, addr)
-	out("250 ok\r\n")
+	if r := s.rcptcheck(); r == 0 {
+		return
+	}
+	if r := s.greylist_check(); r == 0 {
+		s.err_greylist()
+		return
+	}
+	if r := ratelimit("recipients", s.ratelimit_who(), true); r == 0 {
+		s.err_ratelimit("recipients")
+		return
+	}
+	if r := s.queue_rcpt(); r == 0 {
+		return
+	}
+	s.rcptto = append(s.rcptto, s.addr)
+	s.rcptdsn = append(s.rcptdsn, tRcptDsn{s.dsnnotify, s.dsnorcpt})
+	s.reply_out(reply(250, "2.1.5", "ok"))
 }
 
-type safeReader os.File
-
-func (r *safeReader) Read(b []byte) (n int, err error) {
-	flush()
-
-	// we will be died when the timeout expires, so there is no point in buffering the channel
-	done := make(chan struct{})
-	go func() {
-		n, err = (*os.File)(r).Read(b)
-		done <- struct{}{}
-	}()
-
-	tm := time.NewTimer(timeout)
-	select {
-	case <-tm.C:
-		die_alarm()
-		return 0, errors.New("read timeout") // die_* never returns so this will never happen
-	case <-done:
-		tm.Stop()
-		return n, err
+func (s *Session) put(ch byte) {
+	if s.bytestooverflow != 0 {
+		s.bytestooverflow--
+		if s.bytestooverflow == 0 {
+			qmail_fail(&s.qqt)
+		}
+	}
+	s.hdrfilter_put(ch)
+	if s.dkim != nil {
+		dkim_put(s.dkim, ch)
 	}
 }
 
-var ssin = bufio.NewReader((*safeReader)(os.Stdin))
+type tHops struct {
+	hops         int
+	flaginheader bool
+	pos          int  /* number of bytes since most recent \n, if fih */
+	flagmaybex   bool /* 1 if this line might match RECEIVED, if fih */
+	flagmaybey   bool /* 1 if this line might match \r\n, if fih */
+	flagmaybez   bool /* 1 if this line might match DELIVERED, if fih */
+}
 
-var qqt tQmail
-var bytestooverflow uint
+func hops_init(h *tHops) {
+	*h = tHops{flaginheader: true, flagmaybex: true, flagmaybey: true, flagmaybez: true}
+}
 
-func put(ch byte) {
-	if bytestooverflow != 0 {
-		bytestooverflow--
-		if bytestooverflow == 0 {
-			qmail_fail(&qqt)
+func hops_put(h *tHops, ch byte) {
+	if !h.flaginheader {
+		return
+	}
+	if h.pos < 9 {
+		if ch != "delivered"[h.pos] && ch != "DELIVERED"[h.pos] {
+			h.flagmaybez = false
+		}
+		if h.flagmaybez && h.pos == 8 {
+			h.hops++
+		}
+		if h.pos < 8 {
+			if ch != "received"[h.pos] && ch != "RECEIVED"[h.pos] {
+				h.flagmaybex = false
+			}
+		}
+		if h.flagmaybex && h.pos == 7 {
+			h.hops++
+		}
+		if h.pos < 2 && ch != "\r\n"[h.pos] {
+			h.flagmaybey = false
 		}
+		if h.flagmaybey && h.pos == 1 {
+			h.flaginheader = false
+		}
+	}
+	h.pos++
+	if ch == '\n' {
+		h.pos = 0
+		h.flagmaybex = true
+		h.flagmaybey = true
+		h.flagmaybez = true
 	}
-	qmail_putc(&qqt, ch)
 }
 
-func blast() int {
-	hops := 0
+func (s *Session) blast() int {
+	var h tHops
+	hops_init(&h)
 	state := 1
-	flaginheader := true
-	pos := 0           /* number of bytes since most recent \n, if fih */
-	flagmaybex := true /* 1 if this line might match RECEIVED, if fih */
-	flagmaybey := true /* 1 if this line might match \r\n, if fih */
-	flagmaybez := true /* 1 if this line might match DELIVERED, if fih */
 
 	for {
-		ch, _ := ssin.ReadByte()
-
-		if flaginheader {
-			if pos < 9 {
-				if ch != "delivered"[pos] && ch != "DELIVERED"[pos] {
-					flagmaybez = false
-				}
-				if flagmaybez && pos == 8 {
-					hops++
-				}
-				if pos < 8 {
-					if ch != "received"[pos] && ch != "RECEIVED"[pos] {
-						flagmaybex = false
-					}
-				}
-				if flagmaybex && pos == 7 {
-					hops++
-				}
-				if pos < 2 && ch != "\r\n"[pos] {
-					flagmaybey = false
-				}
-				if flagmaybey && pos == 1 {
-					flaginheader = false
-				}
-			}
-			pos++
-			if ch == '\n' {
-				pos = 0
-				flagmaybex = true
-				flagmaybey = true
-				flagmaybez = true
-			}
+		ch, err := s.ssin.ReadByte()
+		if err != nil {
+			s.die_read()
 		}
 
+		hops_put(&h, ch)
+
 		switch state {
 		case 0:
 			if ch == '\n' {
-				straynewline()
+				s.straynewline()
 			}
 			if ch == '\r' {
 				state = 4
@@ -438,7 +565,7 @@ func blast() int {
 			}
 		case 1: /* \r\n */
 			if ch == '\n' {
-				straynewline()
+				s.straynewline()
 			}
 			if ch == '.' {
 				state = 2
@@ -451,7 +578,7 @@ func blast() int {
 			state = 0
 		case 2: /* \r\n + . */
 			if ch == '\n' {
-				straynewline()
+				s.straynewline()
 			}
 			if ch == '\r' {
 				state = 3
@@ -460,10 +587,10 @@ func blast() int {
 			state = 0
 		case 3: /* \r\n + .\r */
 			if ch == '\n' {
-				return hops
+				return h.hops
 			}
-			put('.')
-			put('\r')
+			s.put('.')
+			s.put('\r')
 			if ch == '\r' {
 				state = 4
 				continue
@@ -475,109 +602,163 @@ func blast() int {
 				break
 			}
 			if ch != '\r' {
-				put('\r')
+				s.put('\r')
 				state = 0
 			}
 		}
 
-		put(ch)
+		s.put(ch)
 	}
 }
 
-func acceptmessage(qp int) {
+func (s *Session) acceptmessage(qp int) {
 	when := time.Now()
-	out("250 ok ")
-	out(strconv.Itoa(int(when.Unix())))
-	out(" qt ")
-	out(strconv.Itoa(qp))
-	out("\r\n")
+	s.reply_out(reply(250, "2.0.0", "ok "+strconv.Itoa(int(when.Unix()))+" qt "+strconv.Itoa(qp)))
 }
 
-func smtp_data(_ string) {
-	if !seenmail {
-		err_wantmail()
-		return
-	}
-	if len(rcptto) == 0 {
-		err_wantrcpt()
-		return
+func (s *Session) putheaders() {
+	protocol := "SMTP"
+	if s.ssl != nil {
+		protocol = s.tls_protocol()
 	}
-	seenmail = false
-	if databytes != 0 {
-		bytestooverflow = uint(databytes) + 1
+	if dkimok {
+		s.dkim_start()
 	}
-	if qmail_open(&qqt) == -1 {
-		err_qqt()
-		return
+	hdrfilter_init(&s.hdrfilter)
+	qmail_puts(&s.qqt, s.spfheader)
+	received(&s.qqt, protocol, s.local, s.remoteip, s.remotehost, s.remoteinfo, s.fakehelo)
+	s.dsn_putheaders()
+}
+
+func (s *Session) finishmessage(hops int, qp int) {
+	s.hdrfilter_finish()
+
+	var dkimreply tReply
+	if s.dkim != nil {
+		var header string
+		header, dkimreply = s.dkim_finish()
+		if dkimreply.code != 0 {
+			qmail_fail(&s.qqt)
+		}
+		qmail_release(&s.qqt, header)
 	}
-	qp := qmail_qp(&qqt)
-	out("354 go ahead\r\n")
 
-	received(&qqt, "SMTP", local, remoteip, remotehost, remoteinfo, fakehelo)
-	hops := blast()
 	too_many_hops := hops >= MAXHOPS
 	if too_many_hops {
-		qmail_fail(&qqt)
+		qmail_fail(&s.qqt)
 	}
 
-	qmail_from(&qqt, mailfrom)
-	for _, it := range rcptto {
-		qmail_to(&qqt, it)
+	qmail_from(&s.qqt, s.mailfrom)
+	for _, it := range s.rcptto {
+		qmail_to(&s.qqt, it)
 	}
+	qmail_dsn(&s.qqt, tEnvDsn{s.dsnret, s.dsnenvid, s.rcptdsn})
 
-	qqx := qmail_close(&qqt)
-	if qqx == "" {
-		acceptmessage(qp)
+	qqx := qmail_close(&s.qqt)
+	if qqx.code == 0 {
+		ratelimit("messages", s.ratelimit_who(), true)
+		s.acceptmessage(qp)
 		return
 	}
 	if too_many_hops {
-		out("554 too many hops, this message is looping (#5.4.6)\r\n")
+		s.reply_out(reply(554, "5.4.6", "too many hops, this message is looping"))
 		return
 	}
-	if databytes != 0 && bytestooverflow == 0 {
-		out("552 sorry, that message size exceeds my databytes limit (#5.3.4)\r\n")
+	if databytes != 0 && s.bytestooverflow == 0 {
+		s.err_size()
 		return
 	}
-	if qqx[0] == 'D' {
-		out("554 ")
-	} else {
-		out("451 ")
+	if dkimreply.code != 0 {
+		s.reply_out(dkimreply)
+		return
 	}
-	out(qqx[1:])
-	out("\r\n")
+	s.reply_out(qqx)
 }
 
-func cmd_fun(fn func()) func(string) {
-	return func(_ string) { fn() }
+func (s *Session) smtp_data(_ string) {
+	if s.flagbdat {
+		s.err_bdat()
+		return
+	}
+	if !s.seenmail {
+		s.err_wantmail()
+		return
+	}
+	if len(s.rcptto) == 0 {
+		s.err_wantrcpt()
+		return
+	}
+	s.seenmail = false
+	if databytes != 0 {
+		s.bytestooverflow = uint(databytes) + 1
+	}
+	if qmail_open(&s.qqt, s.queue_backend()) == -1 {
+		s.err_qqt()
+		return
+	}
+	qp := qmail_qp(&s.qqt)
+	s.reply_out(reply(354, "", "go ahead"))
+
+	s.putheaders()
+	hops := s.blast()
+	s.finishmessage(hops, qp)
+}
+
+func cmd_fun(fn func(*Session)) func(*Session, string) {
+	return func(s *Session, _ string) { fn(s) }
 }
 
 var smtpcommands = []tCommands{
-	{"rcpt", smtp_rcpt, nil},
-	{"mail", smtp_mail, nil},
-	{"data", smtp_data, flush},
-	{"quit", smtp_quit, flush},
-	{"helo", smtp_helo, flush},
-	{"ehlo", smtp_ehlo, flush},
-	{"rset", smtp_rset, nil},
-	{"help", smtp_help, flush},
-	{"noop", cmd_fun(err_noop), flush},
-	{"vrfy", cmd_fun(err_vrfy), flush},
-	{"", cmd_fun(err_unimpl), flush},
+	{"rcpt", (*Session).smtp_rcpt, nil},
+	{"mail", (*Session).smtp_mail, nil},
+	{"data", (*Session).smtp_data, (*Session).flush},
+	{"bdat", (*Session).smtp_bdat, nil},
+	{"quit", (*Session).smtp_quit, (*Session).flush},
+	{"helo", (*Session).smtp_helo, (*Session).flush},
+	{"ehlo", (*Session).smtp_ehlo, (*Session).flush},
+	{"rset", (*Session).smtp_rset, nil},
+	{"starttls", (*Session).smtp_starttls, (*Session).flush},
+	{"auth", (*Session).smtp_auth, (*Session).flush},
+	{"help", (*Session).smtp_help, (*Session).flush},
+	{"noop", cmd_fun((*Session).err_noop), (*Session).flush},
+	{"vrfy", cmd_fun((*Session).err_vrfy), (*Session).flush},
+	{"", cmd_fun((*Session).err_unimpl), (*Session).flush},
 }
 
 func main() {
+	flag.StringVar(&listenaddr, "listen", "", "accept connections on `addr` instead of serving stdin")
+	flag.IntVar(&listenlimit, "c", listenlimit, "with -listen, serve at most `n` connections at a time")
+	flag.Parse()
+
 	sig_pipeignore()
 	if err := os.Chdir(auto_qmail); err != nil {
 		log.Fatal(err)
 	}
-	setup()
-	if !ipme_init() {
-		die_ipme()
+	if flag.NArg() > 0 {
+		hostname = flag.Arg(0)
+		childargs = flag.Args()[1:]
 	}
-	smtp_greet("200 ")
-	out(" ESMTP\r\n")
-	if commands(ssin, smtpcommands) == 0 {
-		die_read()
+
+	if listenaddr != "" {
+		if setup() == -1 {
+			log.Fatal("unable to read controls")
+		}
+		if !ipme_init() {
+			log.Fatal("unable to figure out my IP addresses")
+		}
+		listen(listenaddr)
+		return
+	}
+
+	var s Session
+	session_init(&s, &stdioConn{}, _exit)
+	if setup() == -1 {
+		s.die_control()
+	}
+	s.env_setup()
+	s.proxy()
+	if !ipme_init() {
+		s.die_ipme()
 	}
-	die_nomem()
+	s.smtp()
 }
@@ -2,68 +2,37 @@ package main
 
 import (
 	"bufio"
+	"io"
 	"os"
-	"os/exec"
 )
 
-var binqqargs = []string{"bin/qmail-queue"}
-
+/*
+ * The message on its way to the queue backend chosen in
+ * control/queuebackend; see queue.go.
+ */
 type tQmail struct {
-	cmd     *exec.Cmd
+	qb      QueueBackend
 	flagerr bool
-	fdm     *os.File
-	fde     *os.File
 	ss      *bufio.Writer
+	hold    *os.File /* see qmail_hold */
+	from    string
+	to      []string
+	dsn     tEnvDsn
 }
 
-func qmail_open(qq *tQmail) (r int) {
-	defer func() {
-		if r == -1 {
-			qq.cmd = nil
-			if qq.fdm != nil {
-				qq.fdm.Close()
-			}
-			if qq.fde != nil {
-				qq.fde.Close()
-			}
-		}
-	}()
-
-	qq.cmd = exec.Command(binqqargs[0], binqqargs[1:]...)
-	qq.cmd.Dir = auto_qmail
-
-	{
-		pr, pw, err := os.Pipe()
-		if err != nil {
-			return -1
-		}
-		defer pr.Close() // TODO: close pw on children side
-		qq.cmd.Stdin = pr
-		qq.fdm = pw
-	}
-
-	{
-		pr, pw, err := os.Pipe()
-		if err != nil {
-			return -1
-		}
-		defer pr.Close()   // TODO: close pw on children side
-		qq.cmd.Stdout = pr // yes, qmail-queue reads from fd=1 (stdout)
-		qq.fde = pw
-	}
-
-	qq.cmd.Stderr = os.Stderr
-
-	if err := qq.cmd.Start(); err != nil {
+func qmail_open(qq *tQmail, qb QueueBackend) int {
+	*qq = tQmail{}
+	if err := qb.Open(); err != nil {
+		qb.Abort()
 		return -1
 	}
-
-	qq.ss = bufio.NewWriter(qq.fdm)
+	qq.qb = qb
+	qq.ss = bufio.NewWriter(qb)
 	return 0
 }
 
 func qmail_qp(qq *tQmail) int {
-	return qq.cmd.Process.Pid
+	return qq.qb.Qp()
 }
 
 func qmail_fail(qq *tQmail) {
@@ -86,95 +55,96 @@ func qmail_putc(qq *tQmail, ch byte) {
 	}
 }
 
-func qmail_from(qq *tQmail, s string) {
+/*
+ * Until qmail_release, the message goes to a temporary file instead of
+ * qq, so that something learned from the whole message can still be put
+ * in front of it.
+ */
+func qmail_hold(qq *tQmail) {
+	if qq.flagerr {
+		return
+	}
+	fd, err := os.CreateTemp("", "qmail-smtpd")
+	if err != nil {
+		qq.flagerr = true
+		return
+	}
 	if err := qq.ss.Flush(); err != nil {
 		qq.flagerr = true
 	}
-	qq.fdm.Close()
-	qq.ss = bufio.NewWriter(qq.fde)
+	qq.hold = fd
+	qq.ss = bufio.NewWriter(fd)
+}
+
+func qmail_release(qq *tQmail, head string) {
+	if qq.hold == nil {
+		return
+	}
+	fd := qq.hold
+	qq.hold = nil
+	defer os.Remove(fd.Name())
+	defer fd.Close()
 
-	qmail_putc(qq, 'F')
-	qmail_puts(qq, s)
-	qmail_putc(qq, 0)
+	if err := qq.ss.Flush(); err != nil {
+		qq.flagerr = true
+	}
+	qq.ss = bufio.NewWriter(qq.qb)
+	if qq.flagerr {
+		return
+	}
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		qq.flagerr = true
+		return
+	}
+	qmail_puts(qq, head)
+	if _, err := io.Copy(qq.ss, fd); err != nil {
+		qq.flagerr = true
+	}
+}
+
+func qmail_from(qq *tQmail, s string) {
+	qmail_release(qq, "")
+	qq.from = s
 }
 
 func qmail_to(qq *tQmail, s string) {
-	qmail_putc(qq, 'T')
-	qmail_puts(qq, s)
-	qmail_putc(qq, 0)
+	qq.to = append(qq.to, s)
+}
+
+func qmail_dsn(qq *tQmail, dsn tEnvDsn) {
+	qq.dsn = dsn
 }
 
-func qmail_close(qq *tQmail) string {
-	qmail_putc(qq, 0)
+func qmail_close(qq *tQmail) tReply {
+	qb := qq.qb
+	qq.qb = nil
 	if !qq.flagerr {
 		if err := qq.ss.Flush(); err != nil {
 			qq.flagerr = true
 		}
 	}
-	qq.fde.Close()
-
-	// if (wait_pid(&wstat,qq->pid) != qq->pid)
-	// 	return "Zqq waitpid surprise (#4.3.0)"; // WTF?
-	// if (wait_crashed(wstat))
-	// 	return "Zqq crashed (#4.3.0)";
-	if err := qq.cmd.Wait(); err != nil {
-		return "Zqq crashed (#4.3.0)"
+	if !qq.flagerr {
+		if err := qb.Envelope(qq.from, qq.to, qq.dsn); err != nil {
+			qq.flagerr = true
+		}
 	}
+	if qq.flagerr {
+		qb.Abort()
+		return reply(451, "4.3.0", "qq read error")
+	}
+	return queue_reply(qb.Commit(), qq.to)
+}
 
-	exitcode := qq.cmd.ProcessState.ExitCode()
-	switch exitcode {
-	case 115: /* compatibility */
-		fallthrough
-	case 11:
-		return "Denvelope address too long for qq (#5.1.3)"
-	case 31:
-		return "Dmail server permanently rejected message (#5.3.0)"
-	case 51:
-		return "Zqq out of memory (#4.3.0)"
-	case 52:
-		return "Zqq timeout (#4.3.0)"
-	case 53:
-		return "Zqq write error or disk full (#4.3.0)"
-	case 0:
-		if !qq.flagerr {
-			return ""
-		}
-		fallthrough
-	case 54:
-		return "Zqq read error (#4.3.0)"
-	case 55:
-		return "Zqq unable to read configuration (#4.3.0)"
-	case 56:
-		return "Zqq trouble making network connection (#4.3.0)"
-	case 61:
-		return "Zqq trouble in home directory (#4.3.0)"
-	case 63:
-		fallthrough
-	case 64:
-		fallthrough
-	case 65:
-		fallthrough
-	case 66:
-		fallthrough
-	case 62:
-		return "Zqq trouble creating files in queue (#4.3.0)"
-	case 71:
-		return "Zmail server temporarily rejected message (#4.3.0)"
-	case 72:
-		return "Zconnection to mail server timed out (#4.4.1)"
-	case 73:
-		return "Zconnection to mail server rejected (#4.4.1)"
-	case 74:
-		return "Zcommunication with mail server failed (#4.4.2)"
-	case 91:
-		fallthrough
-	case 81:
-		return "Zqq internal bug (#4.3.0)"
-	case 120:
-		return "Zunable to exec qq (#4.3.0)"
-	}
-	if (exitcode >= 11) && (exitcode <= 40) {
-		return "Dqq permanent problem (#5.3.0)"
-	}
-	return "Zqq temporary problem (#4.3.0)"
+/* give up on the message */
+func qmail_abort(qq *tQmail) {
+	if qq.qb == nil {
+		return
+	}
+	if qq.hold != nil {
+		qq.hold.Close()
+		os.Remove(qq.hold.Name())
+		qq.hold = nil
+	}
+	qq.qb.Abort()
+	qq.qb = nil
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+)
+
+/*
+ * The qmail-queue backend: the message on fd 0, the envelope on fd 1.
+ * QMAILQUEUE names another program to run instead of bin/qmail-queue,
+ * as with the qmail-queue patch.
+ */
+
+var binqqargs = []string{"bin/qmail-queue"}
+
+func qmailqueue_init() int {
+	if v := os.Getenv("QMAILQUEUE"); v != "" {
+		binqqargs = []string{v}
+	}
+	return 0
+}
+
+type tQmailQueue struct {
+	cmd *exec.Cmd
+	fdm *os.File
+	fde *os.File
+}
+
+func qmailqueue_new() QueueBackend {
+	return &tQmailQueue{}
+}
+
+func (qq *tQmailQueue) Open() (err error) {
+	defer func() {
+		if err != nil {
+			qq.cmd = nil
+			if qq.fdm != nil {
+				qq.fdm.Close()
+			}
+			if qq.fde != nil {
+				qq.fde.Close()
+			}
+		}
+	}()
+
+	qq.cmd = exec.Command(binqqargs[0], binqqargs[1:]...)
+	qq.cmd.Dir = auto_qmail
+
+	{
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer pr.Close() // TODO: close pw on children side
+		qq.cmd.Stdin = pr
+		qq.fdm = pw
+	}
+
+	{
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer pr.Close()   // TODO: close pw on children side
+		qq.cmd.Stdout = pr // yes, qmail-queue reads from fd=1 (stdout)
+		qq.fde = pw
+	}
+
+	qq.cmd.Stderr = os.Stderr
+
+	return qq.cmd.Start()
+}
+
+func (qq *tQmailQueue) Qp() int {
+	return qq.cmd.Process.Pid
+}
+
+func (qq *tQmailQueue) Write(p []byte) (int, error) {
+	return qq.fdm.Write(p)
+}
+
+func (qq *tQmailQueue) Envelope(from string, to []string, dsn tEnvDsn) error {
+	qq.fdm.Close()
+
+	ss := bufio.NewWriter(qq.fde)
+	ss.WriteByte('F')
+	ss.WriteString(from)
+	ss.WriteByte(0)
+	for _, it := range to {
+		ss.WriteByte('T')
+		ss.WriteString(it)
+		ss.WriteByte(0)
+	}
+	ss.WriteByte(0)
+	return ss.Flush()
+}
+
+func (qq *tQmailQueue) Commit() tQueueResult {
+	qq.fde.Close()
+
+	// if (wait_pid(&wstat,qq->pid) != qq->pid)
+	// 	return "Zqq waitpid surprise (#4.3.0)"; // WTF?
+	// if (wait_crashed(wstat))
+	// 	return "Zqq crashed (#4.3.0)";
+	if err := qq.cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok || !qq.cmd.ProcessState.Exited() {
+			return queue_temporary_result("4.3.0", "qq crashed")
+		}
+	}
+
+	exitcode := qq.cmd.ProcessState.ExitCode()
+	switch exitcode {
+	case 0:
+		return tQueueResult{}
+	case 115: /* compatibility */
+		fallthrough
+	case 11:
+		return queue_permanent_result("5.1.3", "envelope address too long for qq")
+	case 31:
+		return queue_permanent_result("5.3.0", "mail server permanently rejected message")
+	case 51:
+		return queue_temporary_result("4.3.0", "qq out of memory")
+	case 52:
+		return queue_temporary_result("4.3.0", "qq timeout")
+	case 53:
+		return queue_temporary_result("4.3.0", "qq write error or disk full")
+	case 54:
+		return queue_temporary_result("4.3.0", "qq read error")
+	case 55:
+		return queue_temporary_result("4.3.0", "qq unable to read configuration")
+	case 56:
+		return queue_temporary_result("4.3.0", "qq trouble making network connection")
+	case 61:
+		return queue_temporary_result("4.3.0", "qq trouble in home directory")
+	case 63:
+		fallthrough
+	case 64:
+		fallthrough
+	case 65:
+		fallthrough
+	case 66:
+		fallthrough
+	case 62:
+		return queue_temporary_result("4.3.0", "qq trouble creating files in queue")
+	case 71:
+		return queue_temporary_result("4.3.0", "mail server temporarily rejected message")
+	case 72:
+		return queue_temporary_result("4.4.1", "connection to mail server timed out")
+	case 73:
+		return queue_temporary_result("4.4.1", "connection to mail server rejected")
+	case 74:
+		return queue_temporary_result("4.4.2", "communication with mail server failed")
+	case 91:
+		fallthrough
+	case 81:
+		return queue_temporary_result("4.3.0", "qq internal bug")
+	case 120:
+		return queue_temporary_result("4.3.0", "unable to exec qq")
+	}
+	if (exitcode >= 11) && (exitcode <= 40) {
+		return queue_permanent_result("5.3.0", "qq permanent problem")
+	}
+	return queue_temporary_result("4.3.0", "qq temporary problem")
+}
+
+/* qmail-queue cleans up after itself when its input ends early */
+func (qq *tQmailQueue) Abort() {
+	if qq.cmd == nil || qq.cmd.ProcessState != nil {
+		return
+	}
+	qq.fdm.Close()
+	qq.fde.Close()
+	qq.cmd.Wait()
+}
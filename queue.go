@@ -0,0 +1,266 @@
+package main
+
+import (
+	"net/textproto"
+	"strings"
+)
+
+/*
+ * Where accepted mail goes. The first line of control/queuebackend names
+ * the backend:
+ *
+ *   qmail-queue   bin/qmail-queue (the default)
+ *   maildir       straight into Maildirs, see maildir.go
+ *   lmtp          to an LMTP server, see lmtp.go
+ *   smarthost     to another SMTP server, see smarthost.go
+ *
+ * A backend is opened for each message, gets the message through Write,
+ * then the envelope, then Commit. Backends that talk to another server
+ * pass the DSN parameters on if it takes them. Abort throws away
+ * whatever it has been given. Qp is reported to the client after "qt"
+ * when the message is accepted. A backend may also be a
+ * QueueTransaction, which is told about MAIL and RCPT as they happen.
+ */
+type QueueBackend interface {
+	Open() error
+	Write(p []byte) (int, error)
+	Envelope(from string, to []string, dsn tEnvDsn) error
+	Commit() tQueueResult
+	Abort()
+	Qp() int
+}
+
+/*
+ * A backend that has a say while the client waits. Mail is called at
+ * MAIL, and Rcpt for every recipient that we would take; a failure goes
+ * to the client as the reply to MAIL or RCPT. Commit then has the
+ * message for the recipients that Rcpt took. The lmtp and smarthost
+ * backends open their connection in Mail, so that the client hears what
+ * the next hop says about each recipient; Abort ends the transaction.
+ */
+type QueueTransaction interface {
+	Mail(from string, mp tMailParams) tQueueResult
+	Rcpt(to string, dsn tRcptDsn) tQueueResult
+}
+
+/* what the client said on MAIL, for backends that pass it on */
+type tMailParams struct {
+	body string /* BODY=, or "" */
+	utf8 bool   /* SMTPUTF8 */
+	dsn  tEnvDsn
+}
+
+/* the DSN parameters of the transaction (rfc 3461), "" if not given */
+type tEnvDsn struct {
+	ret   string
+	envid string
+	rcpt  []tRcptDsn /* parallel to to */
+}
+
+type tQueueStatus int
+
+const (
+	queue_ok tQueueStatus = iota
+	queue_temporary
+	queue_permanent
+)
+
+/*
+ * What Commit, Mail or Rcpt says; code (if the next hop gave one), ecode
+ * and text go to the client on failure. A backend that learns the fate of
+ * each recipient after the message says so in rcpt, in the order of the
+ * envelope, and leaves status queue_ok.
+ */
+type tQueueResult struct {
+	status tQueueStatus
+	code   int
+	ecode  string
+	text   string
+	rcpt   []tQueueResult
+}
+
+func queue_temporary_result(ecode, text string) tQueueResult {
+	return tQueueResult{status: queue_temporary, ecode: ecode, text: text}
+}
+
+func queue_permanent_result(ecode, text string) tQueueResult {
+	return tQueueResult{status: queue_permanent, ecode: ecode, text: text}
+}
+
+/*
+ * The client gets one reply for the whole message. Recipients are refused
+ * at RCPT where the backend can tell (see QueueTransaction), so what is
+ * left is failures after the message. If the message got to anybody, the
+ * client is told 250, since sending it again would deliver it twice; the
+ * backend has then bounced it to the sender for the others (see
+ * queue_bounce). If it got to nobody, it is 451 if any recipient was a
+ * temporary failure and 554 otherwise, and the reply lists who failed.
+ */
+func queue_reply(qr tQueueResult, to []string) tReply {
+	switch qr.status {
+	case queue_permanent:
+		return reply(554, qr.ecode, qr.text)
+	case queue_temporary:
+		return reply(451, qr.ecode, qr.text)
+	}
+
+	var temp, perm []string
+	var tempecode, permecode string
+	delivered := len(qr.rcpt) == 0
+	for i, it := range qr.rcpt {
+		line := to[i] + ": " + it.text
+		switch it.status {
+		case queue_ok:
+			delivered = true
+		case queue_temporary:
+			if tempecode == "" {
+				tempecode = it.ecode
+			}
+			temp = append(temp, line)
+		case queue_permanent:
+			if permecode == "" {
+				permecode = it.ecode
+			}
+			perm = append(perm, line)
+		}
+	}
+	switch {
+	case delivered:
+		return tReply{}
+	case len(temp) != 0:
+		return reply(451, tempecode, temp...)
+	}
+	return reply(554, permecode, perm...)
+}
+
+/* the reply to MAIL or RCPT that the backend refused */
+func queue_cmdreply(qr tQueueResult) tReply {
+	code := qr.code
+	if code == 0 {
+		code = 451
+		if qr.status == queue_permanent {
+			code = 554
+		}
+	}
+	return reply(code, qr.ecode, qr.text)
+}
+
+/*
+ * The MAIL parameters for the next hop: what the client gave, as far as
+ * the next hop announces it (has).
+ */
+func queue_mailparams(mp tMailParams, has func(ext string) bool) string {
+	x := ""
+	if mp.body != "" && has("8BITMIME") {
+		x += " BODY=" + mp.body
+	}
+	if mp.utf8 && has("SMTPUTF8") {
+		x += " SMTPUTF8"
+	}
+	if has("DSN") {
+		x += dsn_mailparams(mp.dsn)
+	}
+	return x
+}
+
+/* what an SMTP or LMTP server said ("450 4.2.1 text"), as a result */
+func queue_result(err error, who string) tQueueResult {
+	te, ok := err.(*textproto.Error)
+	if !ok {
+		return queue_temporary_result("4.4.2", "communication with "+who+" failed")
+	}
+	msg, _, _ := strings.Cut(te.Msg, "\n")
+	status := queue_temporary
+	ecode := "4.3.0"
+	if te.Code >= 500 {
+		status = queue_permanent
+		ecode = "5.3.0"
+	}
+	if x, rest, ok := strings.Cut(msg, " "); ok && len(x) >= 5 && x[0] == ecode[0] && x[1] == '.' {
+		ecode = x
+		msg = rest
+	}
+	return tQueueResult{status: status, code: te.Code, ecode: ecode, text: msg}
+}
+
+type tQueueDriver struct {
+	init func() int /* reads the backend's own control files; may be nil */
+	new  func() QueueBackend
+}
+
+var queuedrivers = map[string]tQueueDriver{
+	"qmail-queue": {qmailqueue_init, qmailqueue_new},
+	"maildir":     {maildir_init, maildir_new},
+	"lmtp":        {lmtp_init, lmtp_new},
+	"smarthost":   {smarthost_init, smarthost_new},
+}
+
+var queuedriver = queuedrivers["qmail-queue"] /* until queue_init */
+
+func queue_init() int {
+	line, r := control_readline("control/queuebackend")
+	if r == -1 {
+		return -1
+	}
+	name := strings.TrimSpace(line)
+	if name == "" {
+		name = "qmail-queue"
+	}
+	qd, ok := queuedrivers[name]
+	if !ok {
+		return -1
+	}
+	if qd.init != nil && qd.init() == -1 {
+		return -1
+	}
+	queuedriver = qd
+	return 0
+}
+
+/* at MAIL: 1 if the backend, if it has a say, takes the sender */
+func (s *Session) queue_mail() int {
+	s.queue_reset()
+	qb := queuedriver.new()
+	qt, ok := qb.(QueueTransaction)
+	if !ok {
+		return 1
+	}
+	qr := qt.Mail(s.mailfrom, tMailParams{s.mailbody, s.flagutf8, tEnvDsn{ret: s.dsnret, envid: s.dsnenvid}})
+	if qr.status != queue_ok {
+		qb.Abort()
+		s.reply_out(queue_cmdreply(qr))
+		return 0
+	}
+	s.nexthop = qb
+	return 1
+}
+
+/* at RCPT: 1 if the backend takes s.addr; if not, the reply has been given */
+func (s *Session) queue_rcpt() int {
+	if s.nexthop == nil {
+		return 1
+	}
+	qr := s.nexthop.(QueueTransaction).Rcpt(s.addr, tRcptDsn{s.dsnnotify, s.dsnorcpt})
+	if qr.status != queue_ok {
+		s.reply_out(queue_cmdreply(qr))
+		return 0
+	}
+	return 1
+}
+
+/* the transaction is over without a message */
+func (s *Session) queue_reset() {
+	if s.nexthop != nil {
+		s.nexthop.Abort()
+		s.nexthop = nil
+	}
+}
+
+/* the backend for the message: the one from MAIL, if any */
+func (s *Session) queue_backend() QueueBackend {
+	if qb := s.nexthop; qb != nil {
+		s.nexthop = nil
+		return qb
+	}
+	return queuedriver.new()
+}
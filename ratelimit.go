@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Rate limits, one per line in control/ratelimit, what:count:
+ *
+ *   connections:60     per minute, per remoteip
+ *   messages:500       per hour, per remoteip or AUTH user
+ *   recipients:2000    per hour, per remoteip or AUTH user
+ *
+ * Limits that are not listed do not apply. Nobody is exempt, not even
+ * RELAYCLIENT. An IPv6 client counts as its /64, which it most likely
+ * has all to itself. A message counts once it has been accepted; MAIL is
+ * refused only when the limit has been reached. Counters are kept in
+ * var/ratelimit, shared by all qmail-smtpd processes like var/greylist;
+ * if they cannot be kept, there is no limit. Those idle for a day are
+ * swept out.
+ */
+
+type tRateLimit struct {
+	count  int
+	window time.Duration
+}
+
+var ratelimits = map[string]tRateLimit{}
+var ratelimitstore = tStore{"var/ratelimit"}
+
+func ratelimit_init() int {
+	ss, r := control_readfile("control/ratelimit", false)
+	if r != 1 {
+		return r
+	}
+	for _, line := range ss {
+		what, count, _ := strings.Cut(line, ":")
+		var rl tRateLimit
+		switch what {
+		case "connections":
+			rl.window = time.Minute
+		case "messages", "recipients":
+			rl.window = time.Hour
+		default:
+			return -1
+		}
+		i, u := scan_ulong(count)
+		if i == 0 || i != len(count) {
+			return -1
+		}
+		rl.count = int(u)
+		ratelimits[what] = rl
+	}
+	return 0
+}
+
+func (s *Session) die_ratelimit() {
+	s.reply_out(reply(421, "4.7.0", "too many connections from your address, try again later"))
+	s.flush()
+	s._exit(1)
+}
+
+func (s *Session) err_ratelimit(what string) {
+	s.reply_out(reply(451, "4.7.1", "too many "+what+" from you, try again later"))
+}
+
+/* remoteip, or its /64 */
+func ratelimit_ip(remoteip string) string {
+	ip := net.ParseIP(remoteip)
+	if ip == nil || ip.To4() != nil {
+		return "ip\x00" + remoteip
+	}
+	return "ip\x00" + ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+/* whose messages and recipients are counted */
+func (s *Session) ratelimit_who() string {
+	if s.authd {
+		return "user\x00" + s.remoteinfo
+	}
+	return ratelimit_ip(s.remoteip)
+}
+
+/*
+ * 1 if there is room for one more, 0 if not. If add, the one more is
+ * counted.
+ */
+func ratelimit(what, who string, add bool) int {
+	rl, ok := ratelimits[what]
+	if !ok {
+		return 1
+	}
+	store_expire(ratelimitstore, 24*time.Hour)
+
+	/* "start count": count so far in the window that began at start */
+	now := time.Now().Unix()
+	room := true
+	r := store_update(ratelimitstore, what+"\x00"+who, func(data []byte) []byte {
+		f := strings.Fields(string(data))
+		var start int64 = -1
+		count := 0
+		if len(f) == 2 {
+			start, _ = strconv.ParseInt(f[0], 10, 64)
+			count, _ = strconv.Atoi(f[1])
+		}
+		if start < 0 || now < start || time.Duration(now-start)*time.Second >= rl.window {
+			start = now
+			count = 0
+		}
+		if count >= rl.count {
+			room = false
+		} else if add {
+			count++
+		}
+		return []byte(strconv.FormatInt(start, 10) + " " + strconv.Itoa(count) + "\n")
+	})
+	if r == -1 || room {
+		return 1
+	}
+	return 0
+}
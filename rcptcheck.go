@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+ * RCPTCHECK, or else the first line of control/rcptcheck, names a program
+ * (with arguments) that is run for every RCPT, in the qmail directory,
+ * with SENDER, RECIPIENT, REMOTEIP and HELO in its environment. It says
+ * what to do by exiting:
+ *
+ *   0    take the recipient
+ *   100  refuse it, 550
+ *   else try again later, 450; so do crashes and timeouts
+ *
+ * Whatever it prints on stdout, if anything, is the text of the reply.
+ */
+
+var rcptcheckargs []string
+
+func rcptcheck_init() int {
+	if x := os.Getenv("RCPTCHECK"); x != "" {
+		rcptcheckargs = strings.Fields(x)
+		return 0
+	}
+	line, r := control_readline("control/rcptcheck")
+	if r == -1 {
+		return -1
+	}
+	rcptcheckargs = strings.Fields(line)
+	return 0
+}
+
+/* at most 10 lines of printable ascii */
+func rcptcheck_text(out []byte) []string {
+	var text []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.Map(func(r rune) rune {
+			if r < 32 || r > 126 {
+				return -1
+			}
+			return r
+		}, line)
+		if line == "" {
+			continue
+		}
+		if len(line) > 400 {
+			line = line[:400]
+		}
+		text = append(text, line)
+		if len(text) == 10 {
+			break
+		}
+	}
+	return text
+}
+
+/* 1 if the recipient is taken; if not, the reply has been given */
+func (s *Session) rcptcheck() int {
+	if len(rcptcheckargs) == 0 {
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, rcptcheckargs[0], rcptcheckargs[1:]...)
+	cmd.Dir = auto_qmail
+	cmd.Env = append(os.Environ(),
+		"SENDER="+s.mailfrom,
+		"RECIPIENT="+s.addr,
+		"REMOTEIP="+s.remoteip,
+		"HELO="+s.helohost,
+	)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+
+	exitcode := 0
+	if err := cmd.Run(); err != nil {
+		exitcode = -1
+		if ee, ok := err.(*exec.ExitError); ok {
+			exitcode = ee.ExitCode()
+		}
+	}
+
+	text := rcptcheck_text(out.Bytes())
+	switch exitcode {
+	case 0:
+		return 1
+	case 100:
+		if len(text) == 0 {
+			text = []string{"sorry, no mailbox here by that name"}
+		}
+		s.reply_out(reply(550, "5.1.1", text...))
+	default:
+		if len(text) == 0 {
+			text = []string{"temporary problem checking the recipient"}
+		}
+		s.reply_out(reply(450, "4.3.0", text...))
+	}
+	return 0
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"os"
 	"strings"
+
+	"qmail-smtpd/cdb"
 )
 
 var flagrh int
@@ -17,11 +19,20 @@ func rcpthosts_init() int {
 		return flagrh
 	}
 
+	for i := range rh {
+		rh[i] = domain_toascii(rh[i])
+	}
 	constmap_init(maprh, rh)
 
-	// TODO:
-	// fdmrh = open_read("control/morercpthosts.cdb");
-	// if (fdmrh == -1) if (errno != error_noent) return flagrh = -1;
+	fd, err := os.Open("control/morercpthosts.cdb")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			flagrh = -1
+			return flagrh
+		}
+	} else {
+		fdmrh = fd /* kept open for good, shared by all sessions */
+	}
 
 	return 0
 }
@@ -38,7 +49,7 @@ func rcpthosts(buf string) int {
 	}
 
 	j++
-	buf = strings.ToLower(buf[j:])
+	buf = domain_toascii(buf[j:])
 
 	for j := range buf {
 		if j == 0 || buf[j] == '.' {
@@ -48,13 +59,15 @@ func rcpthosts(buf string) int {
 		}
 	}
 
-	// TODO:
-	// for (j = 0;j < len;++j)
-	// 	if (!j || (buf[j] == '.')) {
-	// 		r = cdb_seek(fdmrh,buf + j,len - j,&dlen);
-	// 		if (r) return r;
-	// 	}
-	// }
+	if fdmrh != nil {
+		for j := range buf {
+			if j == 0 || buf[j] == '.' {
+				if _, r := cdb.Seek(fdmrh, []byte(buf[j:])); r != 0 {
+					return r
+				}
+			}
+		}
+	}
 
 	return 0
 }
@@ -0,0 +1,41 @@
+package main
+
+import "strconv"
+
+/* replies (rfc 5321 4.2) with enhanced status codes (rfc 2034, rfc 3463) */
+
+type tReply struct {
+	code  int
+	ecode string   /* x.y.z, or "" if there is none */
+	text  []string /* one per line */
+}
+
+func reply(code int, ecode string, text ...string) tReply {
+	return tReply{code, ecode, text}
+}
+
+/* 250-first line\r\n250 2.0.0 last line\r\n */
+func reply_fmt(r tReply) string {
+	text := r.text
+	if len(text) == 0 {
+		text = []string{""}
+	}
+	var s []byte
+	for i, line := range text {
+		s = strconv.AppendInt(s, int64(r.code), 10)
+		if i < len(text)-1 {
+			s = append(s, '-')
+		} else {
+			s = append(s, ' ')
+		}
+		if r.ecode != "" {
+			s = append(s, r.ecode...)
+			if line != "" {
+				s = append(s, ' ')
+			}
+		}
+		s = append(s, line...)
+		s = append(s, '\r', '\n')
+	}
+	return string(s)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"os"
+	"time"
+)
+
+// Session is everything we know about one SMTP connection. Controls
+// (greeting, databytes, rcpthosts and so on) are shared by all sessions
+// and are read once by setup().
+type Session struct {
+	conn  net.Conn  /* raw connection, see stdioConn */
+	ssl   *tls.Conn /* nil until STARTTLS */
+	ssin  *bufio.Reader
+	ssout *bufio.Writer
+	exit  func(int) /* never returns */
+
+	remoteip      string
+	remotehost    string
+	remoteinfo    string
+	local         string
+	relayclient   string
+	relayclientok bool
+
+	helohost string
+	fakehelo string /* pointer into helohost, or 0 */
+
+	addr  string
+	param tParams /* parameters that came with addr */
+
+	seenmail bool
+	flagbarf bool /* defined if seenmail */
+	mailfrom string
+	rcptto   []string
+
+	mailsize uint
+	mailbody string
+	flagutf8 bool
+
+	dsnret    string
+	dsnenvid  string
+	dsnnotify string /* for the RCPT being parsed */
+	dsnorcpt  string
+	rcptdsn   []tRcptDsn /* parallel to rcptto */
+
+	authd bool
+
+	/* relayclient, relayclientok and remoteinfo as they were before AUTH */
+	connrelayclient   string
+	connrelayclientok bool
+	connremoteinfo    string
+
+	dnsblreply tReply /* code 0 if not listed */
+	spfheader  string /* Received-SPF for this MAIL, or "" */
+
+	nexthop         QueueBackend /* from MAIL, for a QueueTransaction; see queue_mail */
+	qqt             tQmail
+	bytestooverflow uint
+	dkim            *tDkim /* nil unless verifying this message */
+	hdrfilter       tHdrFilter
+
+	flagbdat bool /* BDAT transfer in progress */
+	bdathops tHops
+	bdatcr   bool /* last chunk ended with \r */
+	bdatqp   int
+}
+
+func session_init(s *Session, conn net.Conn, exit func(int)) {
+	*s = Session{conn: conn, exit: exit}
+	s.ssin = bufio.NewReader(safeReader{s})
+	s.ssout = bufio.NewWriter(safeWriter{s})
+	s.remoteip = "unknown"
+	s.remotehost = "unknown"
+	s.local = "unknown"
+}
+
+/* what tcpserver told us */
+func (s *Session) env_setup() {
+	if x := os.Getenv("TCPREMOTEIP"); x != "" {
+		s.remoteip = x
+	}
+
+	if x := os.Getenv("TCPLOCALHOST"); x != "" {
+		s.local = x
+	} else if x := os.Getenv("TCPLOCALIP"); x != "" {
+		s.local = x
+	}
+
+	if x := os.Getenv("TCPREMOTEHOST"); x != "" {
+		s.remotehost = x
+	}
+
+	s.remoteinfo = os.Getenv("TCPREMOTEINFO")
+	s.relayclient, s.relayclientok = os.LookupEnv("RELAYCLIENT")
+}
+
+func (s *Session) smtp() {
+	s.connrelayclient = s.relayclient
+	s.connrelayclientok = s.relayclientok
+	s.connremoteinfo = s.remoteinfo
+	if r := ratelimit("connections", ratelimit_ip(s.remoteip), true); r == 0 {
+		s.die_ratelimit()
+	}
+	s.dnsbl_check()
+	s.dohelo(s.remotehost)
+	s.smtp_greet()
+	if commands(s, smtpcommands) == 0 {
+		s.die_read()
+	}
+	s.die_nomem()
+}
+
+// stdioConn is stdin and stdout as a net.Conn, for running under tcpserver.
+type stdioConn struct {
+	rdeadline time.Time
+	wdeadline time.Time
+}
+
+func deadlineio(t time.Time, fn func() (int, error)) (int, error) {
+	if t.IsZero() {
+		return fn()
+	}
+
+	// we will be died when the deadline expires, so the abandoned goroutine does not matter
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := fn()
+		done <- result{n, err}
+	}()
+
+	tm := time.NewTimer(time.Until(t))
+	defer tm.Stop()
+	select {
+	case <-tm.C:
+		return 0, os.ErrDeadlineExceeded
+	case r := <-done:
+		return r.n, r.err
+	}
+}
+
+func (c *stdioConn) Read(b []byte) (int, error) {
+	return deadlineio(c.rdeadline, func() (int, error) { return os.Stdin.Read(b) })
+}
+
+func (c *stdioConn) Write(b []byte) (int, error) {
+	return deadlineio(c.wdeadline, func() (int, error) { return os.Stdout.Write(b) })
+}
+
+func (c *stdioConn) Close() error         { return nil }
+func (c *stdioConn) LocalAddr() net.Addr  { return nil }
+func (c *stdioConn) RemoteAddr() net.Addr { return nil }
+
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	c.rdeadline = t
+	c.wdeadline = t
+	return nil
+}
+
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { c.rdeadline = t; return nil }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { c.wdeadline = t; return nil }
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/textproto"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* a queue backend that keeps what it is given */
+type tStubQueue struct {
+	msg       bytes.Buffer
+	from      string
+	to        []string
+	committed bool
+}
+
+func (q *tStubQueue) Open() error                 { return nil }
+func (q *tStubQueue) Write(p []byte) (int, error) { return q.msg.Write(p) }
+func (q *tStubQueue) Qp() int                     { return 4242 }
+func (q *tStubQueue) Abort()                      {}
+
+func (q *tStubQueue) Envelope(from string, to []string, dsn tEnvDsn) error {
+	q.from = from
+	q.to = append([]string(nil), to...)
+	return nil
+}
+
+func (q *tStubQueue) Commit() tQueueResult {
+	q.committed = true
+	return tQueueResult{}
+}
+
+/* runs a session on one end of a net.Pipe; the other end is returned */
+func session_pipe(t *testing.T, q QueueBackend) (*textproto.Conn, chan struct{}) {
+	t.Helper()
+	return session_pipe_setup(t, q, nil)
+}
+
+/* as session_pipe; setup, if not nil, gets the session before PROXY */
+func session_pipe_setup(t *testing.T, q QueueBackend, setup func(s *Session)) (*textproto.Conn, chan struct{}) {
+	t.Helper()
+	greeting = "test.local"
+	me = "test.local"
+	saved := queuedriver
+	queuedriver = tQueueDriver{nil, func() QueueBackend { return q }}
+	t.Cleanup(func() { queuedriver = saved })
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		var s Session
+		session_init(&s, server, func(int) { runtime.Goexit() })
+		s.remoteip = "192.0.2.1"
+		if setup != nil {
+			setup(&s)
+		}
+		s.proxy()
+		s.smtp()
+	}()
+	t.Cleanup(func() { client.Close() })
+	return textproto.NewConn(client), done
+}
+
+func expect(t *testing.T, tc *textproto.Conn, code int, cmd string) string {
+	t.Helper()
+	if cmd != "" {
+		if err := tc.PrintfLine("%s", cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	_, msg, err := tc.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%q: %v", cmd, err)
+	}
+	return msg
+}
+
+func TestSessionPipe(t *testing.T) {
+	q := &tStubQueue{}
+	tc, done := session_pipe(t, q)
+
+	expect(t, tc, 220, "")
+	expect(t, tc, 250, "HELO client.example")
+	expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+	expect(t, tc, 250, "RCPT TO:<jane@test.local>")
+	expect(t, tc, 354, "DATA")
+
+	dw := tc.DotWriter()
+	dw.Write([]byte("Subject: hello\n\n.hi there\n"))
+	dw.Close()
+	msg := expect(t, tc, 250, "")
+	if !strings.HasSuffix(msg, " qt 4242") {
+		t.Errorf("DATA: got %q", msg)
+	}
+
+	expect(t, tc, 221, "QUIT")
+	<-done
+
+	if !q.committed {
+		t.Fatal("message was not committed")
+	}
+	if q.from != "joe@example.com" {
+		t.Errorf("from: got %q", q.from)
+	}
+	if len(q.to) != 1 || q.to[0] != "jane@test.local" {
+		t.Errorf("to: got %q", q.to)
+	}
+	body := q.msg.String()
+	if !strings.HasPrefix(body, "Received: from unknown (HELO client.example) (192.0.2.1)\n") {
+		t.Errorf("no Received line: %q", body)
+	}
+	if !strings.HasSuffix(body, "Subject: hello\n\n.hi there\n") {
+		t.Errorf("body: got %q", body)
+	}
+}
+
+func TestSessionHangupInData(t *testing.T) {
+	q := &tStubQueue{}
+	tc, done := session_pipe(t, q)
+
+	expect(t, tc, 220, "")
+	expect(t, tc, 250, "HELO client.example")
+	expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+	expect(t, tc, 250, "RCPT TO:<jane@test.local>")
+	expect(t, tc, 354, "DATA")
+	tc.PrintfLine("Subject: cut short")
+	tc.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still running after the client went away")
+	}
+	if q.committed {
+		t.Error("a message cut short was committed")
+	}
+}
+
+/* takes PROXY headers from ips */
+func proxy_use(t *testing.T, ips ...string) {
+	t.Helper()
+	savedok, saved := proxyok, mapproxy
+	proxyok = true
+	mapproxy = tConstmap{}
+	constmap_init(mapproxy, ips)
+	t.Cleanup(func() { proxyok, mapproxy = savedok, saved })
+}
+
+/* a v2 header: command, family and the addresses and ports that follow */
+func proxy_v2hdr(cmd, fam byte, body []byte) []byte {
+	hdr := append([]byte(nil), proxy_v2sig...)
+	hdr = append(hdr, 0x20|cmd, fam, byte(len(body)>>8), byte(len(body)))
+	return append(hdr, body...)
+}
+
+/* sends a message on tc; returns its Received line */
+func session_received(t *testing.T, tc *textproto.Conn, done chan struct{}, q *tStubQueue) string {
+	t.Helper()
+	expect(t, tc, 220, "")
+	expect(t, tc, 250, "HELO client.example")
+	expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+	expect(t, tc, 250, "RCPT TO:<jane@test.local>")
+	expect(t, tc, 354, "DATA")
+	dw := tc.DotWriter()
+	dw.Write([]byte("Subject: hello\n\nhi\n"))
+	dw.Close()
+	expect(t, tc, 250, "")
+	expect(t, tc, 221, "QUIT")
+	<-done
+	received, _, _ := strings.Cut(q.msg.String(), " with SMTP;")
+	return received
+}
+
+func TestSessionProxy(t *testing.T) {
+	zone_use(t, "7.113.0.203.in-addr.arpa PTR client.example.net\n")
+	proxy_use(t, "192.0.2.1")
+
+	v4 := []byte{203, 0, 113, 7, 198, 51, 100, 25, 0xdc, 0x04, 0, 25}
+	v6 := append(append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::25").To16()...), 0xdc, 0x04, 0, 25)
+	for _, tt := range []struct {
+		name     string
+		hdr      string
+		received string /* "" if the header is refused */
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 198.51.100.25 56324 25\r\n",
+			"Received: from client.example.net (HELO client.example) (203.0.113.7)\n  by 198.51.100.25"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::25 56324 25\r\n",
+			"Received: from unknown (HELO client.example) (2001:db8::7)\n  by 2001:db8::25"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n",
+			"Received: from unknown (HELO client.example) (192.0.2.1)\n  by unknown"},
+		{"v1 unknown with addresses", "PROXY UNKNOWN 203.0.113.7 198.51.100.25 56324 25\r\n",
+			"Received: from unknown (HELO client.example) (192.0.2.1)\n  by unknown"},
+		{"v1 tcp4 with v6", "PROXY TCP4 2001:db8::7 198.51.100.25 56324 25\r\n", ""},
+		{"v1 tcp6 with v4", "PROXY TCP6 203.0.113.7 2001:db8::25 56324 25\r\n", ""},
+		{"v1 bad address", "PROXY TCP4 203.0.113 198.51.100.25 56324 25\r\n", ""},
+		{"v1 bad protocol", "PROXY UDP4 203.0.113.7 198.51.100.25 56324 25\r\n", ""},
+		{"v1 no crlf", "PROXY TCP4 203.0.113.7 198.51.100.25 56324 25\n", ""},
+		{"v2 inet", string(proxy_v2hdr(1, 0x11, v4)),
+			"Received: from client.example.net (HELO client.example) (203.0.113.7)\n  by 198.51.100.25"},
+		{"v2 inet6", string(proxy_v2hdr(1, 0x21, v6)),
+			"Received: from unknown (HELO client.example) (2001:db8::7)\n  by 2001:db8::25"},
+		{"v2 inet with tlvs", string(proxy_v2hdr(1, 0x11, append(v4, 0x04, 0, 1, 0))),
+			"Received: from client.example.net (HELO client.example) (203.0.113.7)\n  by 198.51.100.25"},
+		{"v2 local", string(proxy_v2hdr(0, 0x11, v4)),
+			"Received: from unknown (HELO client.example) (192.0.2.1)\n  by unknown"},
+		{"v2 unspec", string(proxy_v2hdr(1, 0x00, nil)),
+			"Received: from unknown (HELO client.example) (192.0.2.1)\n  by unknown"},
+		{"v2 unix", string(proxy_v2hdr(1, 0x31, make([]byte, 216))),
+			"Received: from unknown (HELO client.example) (192.0.2.1)\n  by unknown"},
+		{"v2 short", string(proxy_v2hdr(1, 0x21, v4)), ""},
+		{"v2 bad command", string(proxy_v2hdr(2, 0x11, v4)), ""},
+		{"v2 bad version", strings.Replace(string(proxy_v2hdr(1, 0x11, v4)), "\x21", "\x11", 1), ""},
+		{"no header", "EHLO client.example\r\n", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &tStubQueue{}
+			tc, done := session_pipe(t, q)
+			tc.W.WriteString(tt.hdr)
+			tc.W.Flush()
+			if tt.received == "" {
+				msg := expect(t, tc, 421, "")
+				if msg != "4.3.0 unable to read PROXY header" {
+					t.Errorf("got %q", msg)
+				}
+				<-done
+				return
+			}
+			if got := session_received(t, tc, done, q); got != tt.received {
+				t.Errorf("got %q, want %q", got, tt.received)
+			}
+		})
+	}
+}
+
+/* relaying was for the proxy, not for the clients behind it */
+func TestSessionProxyRelay(t *testing.T) {
+	zone_use(t, "")
+	proxy_use(t, "192.0.2.1")
+	savedrh, savedmap := flagrh, maprh
+	flagrh = 1
+	maprh = tConstmap{}
+	constmap_init(maprh, []string{"test.local"})
+	t.Cleanup(func() { flagrh, maprh = savedrh, savedmap })
+	relay := func(s *Session) {
+		s.relayclient, s.relayclientok = "", true
+		s.remoteinfo = "proxy"
+	}
+
+	for _, tt := range []struct {
+		hdr  string
+		code int
+	}{
+		{"PROXY TCP4 203.0.113.7 198.51.100.25 56324 25\r\n", 553},
+		{"PROXY UNKNOWN\r\n", 250},
+		{string(proxy_v2hdr(0, 0x00, nil)), 250},
+	} {
+		tc, done := session_pipe_setup(t, &tStubQueue{}, relay)
+		tc.W.WriteString(tt.hdr)
+		tc.W.Flush()
+		expect(t, tc, 220, "")
+		expect(t, tc, 250, "HELO client.example")
+		expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+		expect(t, tc, tt.code, "RCPT TO:<jane@elsewhere.example>")
+		expect(t, tc, 221, "QUIT")
+		<-done
+	}
+}
+
+/* a PROXY header from anybody else is just a bad command */
+func TestSessionProxyNotTrusted(t *testing.T) {
+	proxy_use(t, "192.0.2.99")
+	tc, done := session_pipe(t, &tStubQueue{})
+	expect(t, tc, 220, "")
+	expect(t, tc, 502, "PROXY TCP4 203.0.113.7 198.51.100.25 56324 25")
+	expect(t, tc, 221, "QUIT")
+	<-done
+}
+
+/* one BDAT chunk, as it is; returns the reply */
+func bdat(t *testing.T, tc *textproto.Conn, code int, chunk string, last bool) string {
+	t.Helper()
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	tc.W.WriteString(cmd + "\r\n" + chunk)
+	tc.W.Flush()
+	return expect(t, tc, code, "")
+}
+
+func TestSessionBdat(t *testing.T) {
+	q := &tStubQueue{}
+	tc, done := session_pipe(t, q)
+	expect(t, tc, 220, "")
+	expect(t, tc, 250, "EHLO client.example")
+	expect(t, tc, 501, "MAIL FROM:<joe@example.com> BODY=BINARYMIME")
+	expect(t, tc, 250, "MAIL FROM:<joe@example.com> BODY=8BITMIME")
+	expect(t, tc, 250, "RCPT TO:<jane@test.local>")
+
+	/* a CRLF cut in two by the end of a chunk is still a CRLF */
+	if msg := bdat(t, tc, 250, "Subject: hello\r\n\r\nline one\r", false); msg != "2.0.0 27 octets received" {
+		t.Errorf("BDAT: got %q", msg)
+	}
+	expect(t, tc, 503, "DATA")
+	bdat(t, tc, 250, "\nline two\r\nbare\rcr\r\n\r", false)
+	if msg := bdat(t, tc, 250, "", true); !strings.HasSuffix(msg, " qt 4242") {
+		t.Errorf("BDAT LAST: got %q", msg)
+	}
+	expect(t, tc, 221, "QUIT")
+	<-done
+
+	if !q.committed {
+		t.Fatal("message was not committed")
+	}
+	if body := q.msg.String(); !strings.HasSuffix(body, "\nSubject: hello\n\nline one\nline two\nbare\rcr\n\r") {
+		t.Errorf("body: got %q", body)
+	}
+}
+
+func TestSessionBdatOutOfOrder(t *testing.T) {
+	q := &tStubQueue{}
+	tc, done := session_pipe(t, q)
+	expect(t, tc, 220, "")
+	expect(t, tc, 250, "EHLO client.example")
+	bdat(t, tc, 503, "Subject: too soon\r\n\r\n", true)
+	expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+	bdat(t, tc, 503, "Subject: too soon\r\n\r\n", true)
+	expect(t, tc, 250, "RCPT TO:<jane@test.local>")
+	bdat(t, tc, 250, "Subject: never mind\r\n", false)
+	expect(t, tc, 250, "RSET")
+	expect(t, tc, 503, "RCPT TO:<jane@test.local>")
+	expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+	expect(t, tc, 250, "RCPT TO:<jane@test.local>")
+	bdat(t, tc, 250, "Subject: never mind\r\n", false)
+	expect(t, tc, 501, "BDAT ten")
+	expect(t, tc, 250, "NOOP")
+	expect(t, tc, 221, "QUIT")
+	<-done
+	if q.committed {
+		t.Error("an abandoned message was committed")
+	}
+}
+
+/* hops and databytes count over the whole message, not per chunk */
+func TestSessionBdatLimits(t *testing.T) {
+	saved := databytes
+	t.Cleanup(func() { databytes = saved })
+
+	received := strings.Repeat("Received: from a by b\r\n", 98)
+	for _, tt := range []struct {
+		name      string
+		databytes int
+		chunks    []string
+		code      int
+		ecode     string
+	}{
+		{"99 hops", 0, []string{received, "Delivered-To: joe\r\n\r\nhi\r\n"}, 250, "2.0.0"},
+		{"100 hops", 0, []string{received + "Rece", "ived: from c by d\r\nDelivered-To: joe\r\n\r\nhi\r\n"}, 554, "5.4.6"},
+		{"within databytes", 40, []string{"Subject: a\r\n\r\n" + strings.Repeat("x", 16), strings.Repeat("x", 12)}, 250, "2.0.0"},
+		{"over databytes", 40, []string{"Subject: a\r\n\r\n" + strings.Repeat("x", 16), strings.Repeat("x", 13)}, 552, "5.3.4"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			databytes = tt.databytes
+			q := &tStubQueue{}
+			tc, done := session_pipe(t, q)
+			expect(t, tc, 220, "")
+			expect(t, tc, 250, "EHLO client.example")
+			expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+			expect(t, tc, 250, "RCPT TO:<jane@test.local>")
+			for _, it := range tt.chunks[:len(tt.chunks)-1] {
+				bdat(t, tc, 250, it, false)
+			}
+			if msg := bdat(t, tc, tt.code, tt.chunks[len(tt.chunks)-1], true); !strings.HasPrefix(msg, tt.ecode+" ") {
+				t.Errorf("got %q, want %s", msg, tt.ecode)
+			}
+			expect(t, tc, 221, "QUIT")
+			<-done
+			if q.committed != (tt.code == 250) {
+				t.Errorf("committed: %v", q.committed)
+			}
+		})
+	}
+}
+
+/* greylisting with its store in a temporary directory */
+func greylist_use(t *testing.T, delay time.Duration) {
+	t.Helper()
+	savedok, saveddelay, savedstore := greylistok, greylistdelay, greylist
+	savedips, saveddomains := greylistips, mapgreylistdomains
+	greylistok = true
+	greylistdelay = delay
+	greylist = tStore{t.TempDir()}
+	greylistips = nil
+	mapgreylistdomains = tConstmap{}
+	t.Cleanup(func() {
+		greylistok, greylistdelay, greylist = savedok, saveddelay, savedstore
+		greylistips, mapgreylistdomains = savedips, saveddomains
+	})
+}
+
+/* the reply to RCPT from remoteip */
+func greylist_try(t *testing.T, remoteip, from, to string) int {
+	t.Helper()
+	tc, done := session_pipe_setup(t, &tStubQueue{}, func(s *Session) { s.remoteip = remoteip })
+	expect(t, tc, 220, "")
+	expect(t, tc, 250, "HELO client.example")
+	expect(t, tc, 250, "MAIL FROM:<"+from+">")
+	tc.PrintfLine("RCPT TO:<%s>", to)
+	code, _, err := tc.ReadResponse(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, tc, 221, "QUIT")
+	<-done
+	return code
+}
+
+/* sets the state of a triplet: seen age ago, and whether it got through */
+func greylist_set(t *testing.T, network, from, to string, age time.Duration, passed bool) {
+	t.Helper()
+	flag := "0"
+	if passed {
+		flag = "1"
+	}
+	data := fmt.Sprintf("%d %s\n", time.Now().Add(-age).Unix(), flag)
+	store_update(greylist, network+"\x00"+from+"\x00"+to, func([]byte) []byte { return []byte(data) })
+}
+
+func TestSessionGreylist(t *testing.T) {
+	greylist_use(t, 5*time.Minute)
+	const from, to = "joe@example.com", "jane@test.local"
+	day := 24 * time.Hour
+
+	for _, tt := range []struct {
+		name   string
+		age    time.Duration /* of the triplet, -1 if new */
+		passed bool
+		code   int
+	}{
+		{"new", -1, false, 451},
+		{"too soon", time.Minute, false, 451},
+		{"retried", 10 * time.Minute, false, 250},
+		{"retried too late", 25 * time.Hour, false, 451},
+		{"passed before", 30 * day, true, 250},
+		{"passed long ago", 37 * day, true, 451},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.age >= 0 {
+				greylist_set(t, "192.0.2.0", from, to, tt.age, tt.passed)
+			}
+			if code := greylist_try(t, "192.0.2.1", from, to); code != tt.code {
+				t.Errorf("got %d, want %d", code, tt.code)
+			}
+			/* a triplet that had to wait starts over; one that got through is good again */
+			want := 451
+			if tt.code == 250 {
+				want = 250
+			}
+			if code := greylist_try(t, "192.0.2.1", from, to); code != want {
+				t.Errorf("again: got %d, want %d", code, want)
+			}
+		})
+	}
+
+	/* the whole /24 is one sender, and so is the /64 */
+	greylist_set(t, "192.0.2.0", from, "ann@test.local", 10*time.Minute, false)
+	if code := greylist_try(t, "192.0.2.200", "JOE@example.com", "Ann@test.local"); code != 250 {
+		t.Errorf("same /24: got %d", code)
+	}
+	if code := greylist_try(t, "192.0.3.1", from, "ann@test.local"); code != 451 {
+		t.Errorf("other /24: got %d", code)
+	}
+	greylist_set(t, "2001:db8::", from, to, 10*time.Minute, false)
+	if code := greylist_try(t, "2001:db8::1:2:3:4", from, to); code != 250 {
+		t.Errorf("same /64: got %d", code)
+	}
+}
+
+func TestSessionGreylistExempt(t *testing.T) {
+	greylist_use(t, 5*time.Minute)
+	_, ipnet, _ := net.ParseCIDR("198.51.100.0/24")
+	greylistips = []*net.IPNet{ipnet}
+	constmap_init(mapgreylistdomains, []string{"example.net", "lists.test.local"})
+
+	for _, tt := range []struct {
+		ip, from, to string
+		code         int
+	}{
+		{"192.0.2.1", "joe@example.com", "jane@test.local", 451},
+		{"198.51.100.7", "joe@example.com", "jane@test.local", 250},
+		{"192.0.2.1", "joe@example.net", "jane@test.local", 250},
+		{"192.0.2.1", "joe@example.com", "owner@lists.test.local", 250},
+	} {
+		if code := greylist_try(t, tt.ip, tt.from, tt.to); code != tt.code {
+			t.Errorf("%s %s %s: got %d, want %d", tt.ip, tt.from, tt.to, code, tt.code)
+		}
+	}
+
+	/* if the store cannot be kept, mail goes through */
+	greylist = tStore{"/dev/null/greylist"}
+	if code := greylist_try(t, "192.0.2.1", "joe@example.com", "jane@test.local"); code != 250 {
+		t.Errorf("no store: got %d", code)
+	}
+}
+
+/* rate limits with their store in a temporary directory */
+func ratelimit_use(t *testing.T, limits map[string]tRateLimit) {
+	t.Helper()
+	saved, savedstore := ratelimits, ratelimitstore
+	ratelimits = limits
+	ratelimitstore = tStore{t.TempDir()}
+	t.Cleanup(func() { ratelimits, ratelimitstore = saved, savedstore })
+}
+
+/* sets a counter: count so far in a window that began age ago */
+func ratelimit_set(t *testing.T, what, who string, age time.Duration, count int) {
+	t.Helper()
+	data := fmt.Sprintf("%d %d\n", time.Now().Add(-age).Unix(), count)
+	store_update(ratelimitstore, what+"\x00"+who, func([]byte) []byte { return []byte(data) })
+}
+
+/* the reply to the greeting from remoteip */
+func ratelimit_connect(t *testing.T, remoteip string) int {
+	t.Helper()
+	tc, done := session_pipe_setup(t, &tStubQueue{}, func(s *Session) { s.remoteip = remoteip })
+	code, _, err := tc.ReadResponse(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code == 220 {
+		expect(t, tc, 221, "QUIT")
+	}
+	<-done
+	return code
+}
+
+func TestSessionRatelimitConnections(t *testing.T) {
+	ratelimit_use(t, map[string]tRateLimit{"connections": {2, time.Minute}})
+
+	for i, want := range []int{220, 220, 421, 421} {
+		if code := ratelimit_connect(t, "192.0.2.1"); code != want {
+			t.Errorf("connection %d: got %d, want %d", i+1, code, want)
+		}
+	}
+	if code := ratelimit_connect(t, "192.0.2.2"); code != 220 {
+		t.Errorf("other address: got %d", code)
+	}
+
+	/* a new window */
+	ratelimit_set(t, "connections", "ip\x00192.0.2.1", 61*time.Second, 2)
+	if code := ratelimit_connect(t, "192.0.2.1"); code != 220 {
+		t.Errorf("next minute: got %d", code)
+	}
+	ratelimit_set(t, "connections", "ip\x00192.0.2.1", 59*time.Second, 2)
+	if code := ratelimit_connect(t, "192.0.2.1"); code != 421 {
+		t.Errorf("same minute: got %d", code)
+	}
+
+	/* an IPv6 client is its /64 */
+	for i, want := range []int{220, 220, 421} {
+		if code := ratelimit_connect(t, fmt.Sprintf("2001:db8::%d", i+1)); code != want {
+			t.Errorf("/64 connection %d: got %d, want %d", i+1, code, want)
+		}
+	}
+	if code := ratelimit_connect(t, "2001:db8:0:1::1"); code != 220 {
+		t.Errorf("other /64: got %d", code)
+	}
+}
+
+func TestSessionRatelimitMessages(t *testing.T) {
+	ratelimit_use(t, map[string]tRateLimit{
+		"messages":   {2, time.Hour},
+		"recipients": {3, time.Hour},
+	})
+
+	q := &tStubQueue{}
+	tc, done := session_pipe(t, q)
+	expect(t, tc, 220, "")
+	expect(t, tc, 250, "HELO client.example")
+
+	/* only accepted messages count */
+	for i := 0; i < 3; i++ {
+		expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+		expect(t, tc, 250, "RSET")
+	}
+	for i := 0; i < 2; i++ {
+		expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+		expect(t, tc, 250, "RCPT TO:<jane@test.local>")
+		expect(t, tc, 354, "DATA")
+		dw := tc.DotWriter()
+		dw.Write([]byte("Subject: hello\n\nhi\n"))
+		dw.Close()
+		expect(t, tc, 250, "")
+	}
+	if msg := expect(t, tc, 451, "MAIL FROM:<joe@example.com>"); msg != "4.7.1 too many messages from you, try again later" {
+		t.Errorf("MAIL: got %q", msg)
+	}
+	expect(t, tc, 503, "RCPT TO:<jane@test.local>")
+
+	/* a new window */
+	ratelimit_set(t, "messages", "ip\x00192.0.2.1", 61*time.Minute, 2)
+	expect(t, tc, 250, "MAIL FROM:<joe@example.com>")
+	expect(t, tc, 250, "RCPT TO:<ann@test.local>")
+	if msg := expect(t, tc, 451, "RCPT TO:<bob@test.local>"); msg != "4.7.1 too many recipients from you, try again later" {
+		t.Errorf("RCPT: got %q", msg)
+	}
+	ratelimit_set(t, "recipients", "ip\x00192.0.2.1", 61*time.Minute, 3)
+	expect(t, tc, 250, "RCPT TO:<bob@test.local>")
+	expect(t, tc, 221, "QUIT")
+	<-done
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+/*
+ * The smarthost backend passes messages on by SMTP to another server,
+ * named by the first line of control/smarthost, host or host:port:
+ *
+ *   mail.example.com:587
+ *
+ * The connection is opened at MAIL, and the client gets that server's
+ * own reply to MAIL and to each RCPT, and its 250 only once that server
+ * has taken the message. BODY= and SMTPUTF8 are passed on only if the
+ * client gave them.
+ * STARTTLS is used whenever the server offers it. If
+ * control/smarthostauth has a line user:password, AUTH PLAIN is used as
+ * well, which needs STARTTLS.
+ */
+
+var smarthostaddr string
+var smarthostname string
+var smarthostuser string
+var smarthostpass string
+var smarthostauth bool
+
+func smarthost_init() int {
+	line, r := control_readline("control/smarthost")
+	if r != 1 {
+		return -1
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return -1
+	}
+	host, port, err := net.SplitHostPort(line)
+	if err != nil {
+		host = line
+		port = "25"
+	}
+	smarthostname = host
+	smarthostaddr = net.JoinHostPort(host, port)
+
+	line, r = control_readline("control/smarthostauth")
+	if r == -1 {
+		return -1
+	}
+	if r == 1 {
+		user, pass, ok := strings.Cut(line, ":")
+		if !ok {
+			return -1
+		}
+		smarthostuser = user
+		smarthostpass = pass
+		smarthostauth = true
+	}
+	return 0
+}
+
+type tSmarthost struct {
+	tSpool
+	conn net.Conn
+	c    *smtp.Client
+}
+
+func smarthost_new() QueueBackend {
+	return &tSmarthost{}
+}
+
+func (sh *tSmarthost) Mail(from string, mp tMailParams) tQueueResult {
+	conn, err := net.DialTimeout("tcp", smarthostaddr, timeout)
+	if err != nil {
+		return queue_temporary_result("4.4.1", "connection to smarthost failed")
+	}
+	sh.conn = conn
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, smarthostname)
+	if err != nil {
+		return queue_result(err, "smarthost")
+	}
+	sh.c = c
+	if err := c.Hello(me); err != nil {
+		return queue_result(err, "smarthost")
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: smarthostname}); err != nil {
+			return queue_temporary_result("4.7.0", "TLS negotiation with smarthost failed")
+		}
+	}
+	if smarthostauth {
+		/* a 5xx here is our fault, not the message's */
+		if err := c.Auth(smtp.PlainAuth("", smarthostuser, smarthostpass, smarthostname)); err != nil {
+			return queue_temporary_result("4.7.0", "unable to authenticate to smarthost")
+		}
+	}
+	/* c.Mail and c.Rcpt do not take DSN parameters */
+	has := func(x string) bool {
+		ok, _ := c.Extension(x)
+		return ok
+	}
+	if err := smarthost_cmd(c, "MAIL FROM:<%s>%s", from, queue_mailparams(mp, has)); err != nil {
+		return queue_result(err, "smarthost")
+	}
+	return tQueueResult{}
+}
+
+func (sh *tSmarthost) Rcpt(to string, rd tRcptDsn) tQueueResult {
+	rcptparams := ""
+	if ok, _ := sh.c.Extension("DSN"); ok {
+		rcptparams = dsn_rcptparams(rd)
+	}
+	sh.conn.SetDeadline(time.Now().Add(timeout))
+	if err := smarthost_cmd(sh.c, "RCPT TO:<%s>%s", to, rcptparams); err != nil {
+		return queue_result(err, "smarthost")
+	}
+	return tQueueResult{}
+}
+
+/* the smarthost took every recipient in to at RCPT */
+func (sh *tSmarthost) Envelope(from string, to []string, dsn tEnvDsn) error {
+	return nil
+}
+
+/* the answer to DATA is for everybody */
+func (sh *tSmarthost) Commit() tQueueResult {
+	defer sh.Abort()
+	if sh.c == nil {
+		return queue_temporary_result("4.3.0", "no smarthost transaction")
+	}
+
+	sh.conn.SetDeadline(time.Now().Add(timeout))
+	w, err := sh.c.Data()
+	if err != nil {
+		return queue_result(err, "smarthost")
+	}
+	if err := sh.rewind(); err != nil {
+		return queue_temporary_result("4.3.0", "unable to read spooled message")
+	}
+	if _, err := io.Copy(w, sh.spool); err != nil { /* \n to \r\n, and the dots */
+		return queue_result(err, "smarthost")
+	}
+	if err := w.Close(); err != nil {
+		return queue_result(err, "smarthost")
+	}
+	return tQueueResult{}
+}
+
+func (sh *tSmarthost) Abort() {
+	if sh.c != nil {
+		sh.conn.SetDeadline(time.Now().Add(timeout))
+		if sh.c.Quit() != nil {
+			sh.c.Close()
+		}
+		sh.c = nil
+	} else if sh.conn != nil {
+		sh.conn.Close()
+	}
+	sh.conn = nil
+	sh.tSpool.Abort()
+}
+
+func smarthost_cmd(c *smtp.Client, format string, args ...any) error {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(2)
+	return err
+}
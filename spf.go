@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * SPF (rfc 7208) for the envelope sender, or for the HELO name if the
+ * sender is <>. Checked on MAIL unless RELAYCLIENT is set; the result goes
+ * into a Received-SPF header above our Received line.
+ *
+ * SPF is off unless control/spfpolicy exists. It says what to do with
+ * each result, result:action, where action is one of
+ *
+ *   reject  550, the MAIL is refused
+ *   defer   451, the MAIL is refused for now
+ *   tag     only write the header
+ *
+ * Results that are not listed are tagged, so an empty file means tag
+ * everything. For example:
+ *
+ *   fail:reject
+ *   softfail:tag
+ *   temperror:defer
+ *
+ * The exp modifier is ignored and %{p} is always "unknown".
+ */
+
+const (
+	spf_none      = "none"
+	spf_neutral   = "neutral"
+	spf_pass      = "pass"
+	spf_fail      = "fail"
+	spf_softfail  = "softfail"
+	spf_temperror = "temperror"
+	spf_permerror = "permerror"
+)
+
+var spfok bool
+var spfpolicy = map[string]string{}
+
+func spf_init() int {
+	ss, r := control_readfile("control/spfpolicy", false)
+	if r != 1 {
+		return r
+	}
+	for _, line := range ss {
+		result, action, _ := strings.Cut(line, ":")
+		result = strings.ToLower(strings.TrimSpace(result))
+		action = strings.ToLower(strings.TrimSpace(action))
+		switch result {
+		case spf_none, spf_neutral, spf_pass, spf_fail, spf_softfail, spf_temperror, spf_permerror:
+		default:
+			return -1
+		}
+		switch action {
+		case "reject", "defer", "tag":
+		default:
+			return -1
+		}
+		spfpolicy[result] = action
+	}
+	spfok = true
+	return 0
+}
+
+type tSpf struct {
+	ctx     context.Context
+	ip      net.IP
+	sender  string /* local@domain */
+	helo    string
+	lookups int /* terms that cost a DNS query, at most 10 */
+	voids   int /* queries that came back empty, at most 2 */
+}
+
+type tSpfTerm struct {
+	qualifier byte
+	name      string
+	arg       string /* domain-spec or address, "" if none */
+	cidr4     int
+	cidr6     int
+}
+
+/* the mechanism matched, or did not; anything else is a result */
+const (
+	spf_match   = "match"
+	spf_nomatch = ""
+)
+
+func spf_isrecord(txt string) bool {
+	return len(txt) >= 6 && strings.EqualFold(txt[:6], "v=spf1") && (len(txt) == 6 || txt[6] == ' ')
+}
+
+/* rfc 7208 4.3: a name we will not even look up */
+func spf_domainok(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if len(domain) > 253 || strings.IndexByte(domain, '.') == -1 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+var spf_dualcidr = regexp.MustCompile(`^(.*?)(?:/([0-9]+))?(?://([0-9]+))?$`)
+
+func spf_parseterm(term string) (tSpfTerm, bool) {
+	t := tSpfTerm{qualifier: '+', cidr4: 32, cidr6: 128}
+	if strings.IndexByte("+-~?", term[0]) != -1 {
+		t.qualifier = term[0]
+		term = term[1:]
+	}
+
+	name, arg, colon := strings.Cut(term, ":")
+	if i := strings.IndexByte(name, '/'); i != -1 && !colon {
+		name, arg = name[:i], name[i:]
+	}
+	t.name = strings.ToLower(name)
+
+	switch t.name {
+	case "all":
+		return t, arg == "" && !colon
+	case "include", "exists":
+		t.arg = arg
+		return t, colon && arg != ""
+	case "ptr":
+		t.arg = arg
+		return t, !colon || arg != ""
+	case "a", "mx", "ip4", "ip6":
+	default:
+		return t, false
+	}
+
+	m := spf_dualcidr.FindStringSubmatch(arg)
+	t.arg = m[1]
+	if colon && t.arg == "" {
+		return t, false
+	}
+	if t.name == "ip6" { /* ip6:addr/len, no dual cidr */
+		if m[3] != "" {
+			return t, false
+		}
+		m[2], m[3] = "", m[2]
+	}
+	if m[2] != "" {
+		t.cidr4, _ = strconv.Atoi(m[2])
+	}
+	if m[3] != "" {
+		t.cidr6, _ = strconv.Atoi(m[3])
+	}
+	if t.cidr4 > 32 || t.cidr6 > 128 {
+		return t, false
+	}
+
+	switch t.name {
+	case "ip4":
+		ip := net.ParseIP(t.arg)
+		return t, ip != nil && !strings.Contains(t.arg, ":")
+	case "ip6":
+		ip := net.ParseIP(t.arg)
+		return t, ip != nil && strings.Contains(t.arg, ":")
+	}
+	return t, true
+}
+
+func spf_ismodifier(term string) (string, string, bool) {
+	name, value, ok := strings.Cut(term, "=")
+	if !ok || name == "" || strings.ContainsAny(name, ":/") {
+		return "", "", false
+	}
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		alpha := (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+		if i == 0 && !alpha {
+			return "", "", false
+		}
+		if !alpha && !(ch >= '0' && ch <= '9') && ch != '-' && ch != '_' && ch != '.' {
+			return "", "", false
+		}
+	}
+	return strings.ToLower(name), value, true
+}
+
+/* the i macro: dotted quad, or a dot between every nibble */
+func spf_macroip(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	var b strings.Builder
+	for i, ch := range ip.To16() {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteByte("0123456789abcdef"[ch>>4])
+		b.WriteByte('.')
+		b.WriteByte("0123456789abcdef"[ch&15])
+	}
+	return b.String()
+}
+
+/* rfc 7208 7: %{s} and friends in a domain-spec */
+func (c *tSpf) expand(spec, domain string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		i++
+		if i == len(spec) {
+			return "", false
+		}
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", false
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", false
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		letter := macro[0]
+		var value string
+		switch letter | 0x20 {
+		case 's':
+			value = c.sender
+		case 'l':
+			value, _, _ = strings.Cut(c.sender, "@")
+		case 'o':
+			_, value, _ = strings.Cut(c.sender, "@")
+		case 'd':
+			value = domain
+		case 'i':
+			value = spf_macroip(c.ip)
+		case 'p':
+			value = "unknown"
+		case 'v':
+			value = "ip6"
+			if c.ip.To4() != nil {
+				value = "in-addr"
+			}
+		case 'h':
+			value = c.helo
+		default:
+			return "", false
+		}
+		macro = macro[1:]
+
+		digits := 0
+		for len(macro) > 0 && macro[0] >= '0' && macro[0] <= '9' {
+			digits = digits*10 + int(macro[0]-'0')
+			macro = macro[1:]
+		}
+		reverse := false
+		if len(macro) > 0 && (macro[0] == 'r' || macro[0] == 'R') {
+			reverse = true
+			macro = macro[1:]
+		}
+		delims := macro
+		if delims == "" {
+			delims = "."
+		}
+		if strings.Trim(delims, ".-+,/_=") != "" {
+			return "", false
+		}
+
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delims, r) })
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if digits > 0 && digits < len(parts) {
+			parts = parts[len(parts)-digits:]
+		}
+		value = strings.Join(parts, ".")
+
+		if letter >= 'A' && letter <= 'Z' {
+			value = url_escape(value)
+		}
+		b.WriteString(value)
+	}
+
+	out := strings.TrimSuffix(b.String(), ".")
+	for len(out) > 253 {
+		_, rest, ok := strings.Cut(out, ".")
+		if !ok {
+			return "", false
+		}
+		out = rest
+	}
+	return out, true
+}
+
+func url_escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || strings.IndexByte("-._~", ch) != -1 {
+			b.WriteByte(ch)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte("0123456789ABCDEF"[ch>>4])
+		b.WriteByte("0123456789ABCDEF"[ch&15])
+	}
+	return b.String()
+}
+
+func (c *tSpf) lookup() bool {
+	c.lookups++
+	return c.lookups <= 10
+}
+
+func (c *tSpf) void(err error) string {
+	if dns_notfound(err) {
+		c.voids++
+		if c.voids > 2 {
+			return spf_permerror
+		}
+		return spf_nomatch
+	}
+	return spf_temperror
+}
+
+func (c *tSpf) ipmatch(addrs []string, t tSpfTerm) bool {
+	for _, it := range addrs {
+		ip := net.ParseIP(it)
+		if ip == nil || (ip.To4() == nil) != (c.ip.To4() == nil) {
+			continue
+		}
+		bits, ones := 128, t.cidr6
+		if c.ip.To4() != nil {
+			bits, ones = 32, t.cidr4
+			ip = ip.To4()
+		}
+		if (&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}).Contains(c.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *tSpf) mechanism(t tSpfTerm, domain string) string {
+	target := domain
+	if t.arg != "" && t.name != "ip4" && t.name != "ip6" {
+		var ok bool
+		if target, ok = c.expand(t.arg, domain); !ok {
+			return spf_permerror
+		}
+	}
+
+	switch t.name {
+	case "all":
+		return spf_match
+
+	case "include":
+		if !c.lookup() {
+			return spf_permerror
+		}
+		switch c.check_host(target) {
+		case spf_pass:
+			return spf_match
+		case spf_fail, spf_softfail, spf_neutral:
+			return spf_nomatch
+		case spf_temperror:
+			return spf_temperror
+		}
+		return spf_permerror
+
+	case "a":
+		if !c.lookup() {
+			return spf_permerror
+		}
+		addrs, err := resolver.LookupHost(c.ctx, target)
+		if err != nil {
+			return c.void(err)
+		}
+		if c.ipmatch(addrs, t) {
+			return spf_match
+		}
+		return spf_nomatch
+
+	case "mx":
+		if !c.lookup() {
+			return spf_permerror
+		}
+		mxs, err := resolver.LookupMX(c.ctx, target)
+		if err != nil {
+			return c.void(err)
+		}
+		if len(mxs) > 10 {
+			return spf_permerror
+		}
+		for _, mx := range mxs {
+			addrs, err := resolver.LookupHost(c.ctx, strings.TrimSuffix(mx.Host, "."))
+			if err != nil {
+				if r := c.void(err); r != spf_nomatch {
+					return r
+				}
+				continue
+			}
+			if c.ipmatch(addrs, t) {
+				return spf_match
+			}
+		}
+		return spf_nomatch
+
+	case "ptr":
+		if !c.lookup() {
+			return spf_permerror
+		}
+		names, err := resolver.LookupAddr(c.ctx, c.ip.String())
+		if err != nil {
+			if dns_notfound(err) {
+				c.voids++
+			}
+			return spf_nomatch
+		}
+		if len(names) > 10 {
+			names = names[:10]
+		}
+		target = strings.ToLower(target)
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name != target && !strings.HasSuffix(name, "."+target) {
+				continue
+			}
+			addrs, err := resolver.LookupHost(c.ctx, name)
+			if err != nil {
+				continue
+			}
+			if c.ipmatch(addrs, tSpfTerm{cidr4: 32, cidr6: 128}) {
+				return spf_match
+			}
+		}
+		return spf_nomatch
+
+	case "ip4", "ip6":
+		if c.ipmatch([]string{t.arg}, t) {
+			return spf_match
+		}
+		return spf_nomatch
+
+	case "exists":
+		if !c.lookup() {
+			return spf_permerror
+		}
+		if _, err := resolver.LookupHost(c.ctx, target); err != nil {
+			return c.void(err)
+		}
+		return spf_match
+	}
+	return spf_permerror
+}
+
+func (c *tSpf) check_host(domain string) string {
+	if !spf_domainok(domain) {
+		return spf_none
+	}
+
+	txts, err := resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if dns_notfound(err) {
+			return spf_none
+		}
+		return spf_temperror
+	}
+	var record string
+	n := 0
+	for _, txt := range txts {
+		if spf_isrecord(txt) {
+			record = txt
+			n++
+		}
+	}
+	if n == 0 {
+		return spf_none
+	}
+	if n > 1 {
+		return spf_permerror
+	}
+
+	/* any syntax error makes the whole record a permerror, so parse it all first */
+	var terms []tSpfTerm
+	var redirect string
+	var seenexp bool
+	for _, term := range strings.Fields(record)[1:] {
+		if name, value, ok := spf_ismodifier(term); ok {
+			switch name {
+			case "redirect":
+				if redirect != "" || value == "" {
+					return spf_permerror
+				}
+				redirect = value
+			case "exp":
+				if seenexp || value == "" {
+					return spf_permerror
+				}
+				seenexp = true
+			}
+			continue
+		}
+		t, ok := spf_parseterm(term)
+		if !ok {
+			return spf_permerror
+		}
+		terms = append(terms, t)
+	}
+
+	for _, t := range terms {
+		switch r := c.mechanism(t, domain); r {
+		case spf_match:
+			switch t.qualifier {
+			case '-':
+				return spf_fail
+			case '~':
+				return spf_softfail
+			case '?':
+				return spf_neutral
+			}
+			return spf_pass
+		case spf_nomatch:
+		default:
+			return r
+		}
+	}
+
+	if redirect != "" {
+		if !c.lookup() {
+			return spf_permerror
+		}
+		target, ok := c.expand(redirect, domain)
+		if !ok {
+			return spf_permerror
+		}
+		if r := c.check_host(target); r != spf_none {
+			return r
+		}
+		return spf_permerror
+	}
+
+	return spf_neutral
+}
+
+/* header comments and reply texts, after rfc 7208 9.1 */
+func spf_comment(result, who, ip string) string {
+	switch result {
+	case spf_pass:
+		return "domain of " + who + " designates " + ip + " as permitted sender"
+	case spf_fail:
+		return "domain of " + who + " does not designate " + ip + " as permitted sender"
+	case spf_softfail:
+		return "domain of transitioning " + who + " does not designate " + ip + " as permitted sender"
+	case spf_neutral:
+		return ip + " is neither permitted nor denied by domain of " + who
+	case spf_none:
+		return "domain of " + who + " does not designate permitted sender hosts"
+	case spf_temperror:
+		return "error in processing during lookup of " + who
+	}
+	return "domain of " + who + " has a broken SPF record"
+}
+
+/* printable ascii without quotes, for a quoted-string */
+func spf_quote(str string) string {
+	b := []byte(str)
+	for i, ch := range b {
+		if ch < 32 || ch > 126 || ch == '"' || ch == '\\' {
+			b[i] = '?'
+		}
+	}
+	return `"` + string(b) + `"`
+}
+
+func (s *Session) spf_check() int {
+	s.spfheader = ""
+	if !spfok || s.relayclientok {
+		return 1
+	}
+	ip := net.ParseIP(s.remoteip)
+	if ip == nil {
+		return 1
+	}
+
+	ctx, cancel := dns_ctx()
+	defer cancel()
+	c := tSpf{ctx: ctx, ip: ip, helo: s.helohost}
+
+	identity := "mailfrom"
+	var domain string
+	if j := strings.LastIndexByte(s.mailfrom, '@'); j > 0 {
+		c.sender = s.mailfrom
+		domain = s.mailfrom[j+1:]
+	} else if j == 0 {
+		c.sender = "postmaster" + s.mailfrom
+		domain = s.mailfrom[1:]
+	} else {
+		identity = "helo"
+		c.sender = "postmaster@" + s.helohost
+		domain = s.helohost
+	}
+	result := c.check_host(domain)
+
+	who := c.sender
+	if identity == "helo" {
+		who = s.helohost
+	}
+	comment := spf_comment(result, who, s.remoteip)
+
+	header := "Received-SPF: " + result + " ("
+	if meok {
+		header += me + ": "
+	}
+	header += comment + ")\n\tclient-ip=" + s.remoteip + "; envelope-from=" + spf_quote(s.mailfrom) +
+		"; helo=" + spf_quote(s.helohost) + ";"
+	if meok {
+		header += " receiver=" + me + ";"
+	}
+	header += " identity=" + identity + ";\n"
+	s.spfheader = strings.Map(func(r rune) rune {
+		if r >= 0x80 {
+			return '?'
+		}
+		return r
+	}, header)
+
+	switch spfpolicy[result] {
+	case "reject":
+		ecode := "5.7.23"
+		if result != spf_fail && result != spf_softfail {
+			ecode = "5.7.24"
+		}
+		s.reply_out(reply(550, ecode, "sorry, SPF "+result+": "+comment))
+		return 0
+	case "defer":
+		s.reply_out(reply(451, "4.7.24", "SPF "+result+": "+comment+", try again later"))
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+const spf_zone = `pass.example TXT v=spf1 ip4:192.0.2.0/24 -all
+pass.example TXT some other text
+fail.example TXT v=spf1 -all
+inc.example TXT v=spf1 include:pass.example -all
+incfail.example TXT v=spf1 include:fail.example ~all
+incnone.example TXT v=spf1 include:nothing.example -all
+redir.example TXT v=spf1 redirect=pass.example
+redirnone.example TXT v=spf1 redirect=nothing.example
+mx.example TXT v=spf1 mx -all
+mx.example MX 20 mail2.mx.example
+mx.example MX 10 mail.mx.example
+mail.mx.example A 198.51.100.1
+mail2.mx.example A 192.0.2.1
+a.example TXT v=spf1 a:host.a.example/24 ?all
+host.a.example A 192.0.2.200
+macro.example TXT v=spf1 exists:%{ir}.%{l1r-}.allow.%{d} -all
+1.2.0.192.joe.allow.macro.example A 127.0.0.2
+helo.example TXT v=spf1 a:%{h} -all
+helo.example A 192.0.2.1
+two.example TXT v=spf1 -all
+two.example TXT v=spf1 +all
+syntax.example TXT v=spf1 ip4:192.0.2 -all
+ten.example TXT v=spf1 a:n1.example a:n2.example a:n3.example a:n4.example a:n5.example a:n6.example a:n7.example a:n8.example a:n9.example a:n10.example -all
+eleven.example TXT v=spf1 a:n1.example a:n2.example a:n3.example a:n4.example a:n5.example a:n6.example a:n7.example a:n8.example a:n9.example a:n10.example a:n11.example -all
+n1.example A 198.51.100.1
+n2.example A 198.51.100.2
+n3.example A 198.51.100.3
+n4.example A 198.51.100.4
+n5.example A 198.51.100.5
+n6.example A 198.51.100.6
+n7.example A 198.51.100.7
+n8.example A 198.51.100.8
+n9.example A 198.51.100.9
+n10.example A 198.51.100.10
+n11.example A 198.51.100.11
+voids2.example TXT v=spf1 a:v1.example a:v2.example -all
+voids3.example TXT v=spf1 a:v1.example a:v2.example a:v3.example -all
+`
+
+/* a zone in which names under broken.example time out */
+type tBrokenZone struct{ tZone }
+
+func (z tBrokenZone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if strings.HasSuffix(name, "broken.example") {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}
+	return z.tZone.LookupTXT(ctx, name)
+}
+
+func TestSpfCheckHost(t *testing.T) {
+	zone_use(t, spf_zone)
+	for _, tt := range []struct {
+		ip     string
+		sender string
+		domain string
+		result string
+	}{
+		{"192.0.2.1", "joe@pass.example", "pass.example", spf_pass},
+		{"198.51.100.1", "joe@pass.example", "pass.example", spf_fail},
+		{"192.0.2.1", "joe@fail.example", "fail.example", spf_fail},
+		{"192.0.2.1", "joe@none.example", "none.example", spf_none},
+		{"192.0.2.1", "joe@localhost", "localhost", spf_none},
+		{"192.0.2.1", "joe@inc.example", "inc.example", spf_pass},
+		{"192.0.2.1", "joe@incfail.example", "incfail.example", spf_softfail},
+		{"192.0.2.1", "joe@incnone.example", "incnone.example", spf_permerror},
+		{"192.0.2.1", "joe@redir.example", "redir.example", spf_pass},
+		{"198.51.100.1", "joe@redir.example", "redir.example", spf_fail},
+		{"192.0.2.1", "joe@redirnone.example", "redirnone.example", spf_permerror},
+		{"192.0.2.1", "joe@mx.example", "mx.example", spf_pass},
+		{"198.51.100.1", "joe@mx.example", "mx.example", spf_pass},
+		{"203.0.113.1", "joe@mx.example", "mx.example", spf_fail},
+		{"192.0.2.1", "joe@a.example", "a.example", spf_pass},
+		{"192.0.3.1", "joe@a.example", "a.example", spf_neutral},
+		{"192.0.2.1", "joe-x@macro.example", "macro.example", spf_pass},
+		{"192.0.2.1", "ann@macro.example", "macro.example", spf_fail},
+		{"192.0.2.2", "joe-x@macro.example", "macro.example", spf_fail},
+		{"192.0.2.1", "postmaster@helo.example", "helo.example", spf_pass},
+		{"192.0.2.1", "joe@two.example", "two.example", spf_permerror},
+		{"192.0.2.1", "joe@syntax.example", "syntax.example", spf_permerror},
+		{"192.0.2.1", "joe@ten.example", "ten.example", spf_fail},
+		{"192.0.2.1", "joe@eleven.example", "eleven.example", spf_permerror},
+		{"192.0.2.1", "joe@voids2.example", "voids2.example", spf_fail},
+		{"192.0.2.1", "joe@voids3.example", "voids3.example", spf_permerror},
+	} {
+		c := tSpf{ctx: context.Background(), ip: net.ParseIP(tt.ip), sender: tt.sender, helo: "helo.example"}
+		if r := c.check_host(tt.domain); r != tt.result {
+			t.Errorf("%s from %s: got %s, want %s", tt.sender, tt.ip, r, tt.result)
+		}
+	}
+}
+
+func TestSpfExpand(t *testing.T) {
+	c := tSpf{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+	for _, tt := range []struct{ spec, out string }{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"%{h}", "mx.example.org"},
+		{"%{S}", "strong-bad%40email.example.com"},
+		{"%%%_%-", "% %20"},
+	} {
+		out, ok := c.expand(tt.spec, "email.example.com")
+		if !ok || out != tt.out {
+			t.Errorf("%s: got %q %v, want %q", tt.spec, out, ok, tt.out)
+		}
+	}
+	for _, spec := range []string{"%", "%{x}", "%{", "%a", "%{l!}"} {
+		if _, ok := c.expand(spec, "email.example.com"); ok {
+			t.Errorf("%s: expanded", spec)
+		}
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	out, _ := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	if out != "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com" {
+		t.Errorf("ipv6 %%{ir}: got %q", out)
+	}
+}
+
+func TestSpfPolicy(t *testing.T) {
+	zone_use(t, spf_zone)
+	resolver = tBrokenZone{resolver.(tZone)}
+	savedok, saved := spfok, spfpolicy
+	spfok = true
+	spfpolicy = map[string]string{
+		spf_fail:      "reject",
+		spf_softfail:  "tag",
+		spf_temperror: "defer",
+		spf_permerror: "reject",
+	}
+	t.Cleanup(func() { spfok, spfpolicy = savedok, saved })
+
+	q := &tStubQueue{}
+	tc, done := session_pipe(t, q)
+	expect(t, tc, 220, "")
+	expect(t, tc, 250, "HELO client.example")
+	for _, tt := range []struct {
+		from string
+		code int
+		text string
+	}{
+		{"joe@fail.example", 550, "5.7.23 sorry, SPF fail: domain of joe@fail.example does not designate 192.0.2.1 as permitted sender"},
+		{"joe@redirnone.example", 550, "5.7.24 sorry, SPF permerror: domain of joe@redirnone.example has a broken SPF record"},
+		{"joe@broken.example", 451, "4.7.24 SPF temperror: error in processing during lookup of joe@broken.example, try again later"},
+		{"joe@none.example", 250, "2.1.0 ok"},
+		{"joe@incfail.example", 250, "2.1.0 ok"},
+	} {
+		if msg := expect(t, tc, tt.code, "MAIL FROM:<"+tt.from+">"); msg != tt.text {
+			t.Errorf("%s: got %q, want %q", tt.from, msg, tt.text)
+		}
+	}
+	expect(t, tc, 250, "RCPT TO:<jane@test.local>")
+	expect(t, tc, 354, "DATA")
+	dw := tc.DotWriter()
+	dw.Write([]byte("Subject: hello\n\nhi\n"))
+	dw.Close()
+	expect(t, tc, 250, "")
+	expect(t, tc, 221, "QUIT")
+	<-done
+
+	want := "Received-SPF: softfail (domain of transitioning joe@incfail.example does not designate 192.0.2.1 as permitted sender)\n" +
+		"\tclient-ip=192.0.2.1; envelope-from=\"joe@incfail.example\"; helo=\"client.example\"; identity=mailfrom;\n" +
+		"Received: "
+	if !strings.HasPrefix(q.msg.String(), want) {
+		t.Errorf("header: got %q", q.msg.String())
+	}
+}
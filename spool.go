@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+/*
+ * The message in a temporary file, for backends that need all of it
+ * before they can start: maildir, lmtp and smarthost embed it for Open,
+ * Write, Qp and Abort. Qp is our pid; there is no queue to number the
+ * message.
+ */
+type tSpool struct {
+	spool *os.File
+}
+
+func (sp *tSpool) Open() error {
+	fd, err := os.CreateTemp("", "qmail-smtpd")
+	if err != nil {
+		return err
+	}
+	sp.spool = fd
+	return nil
+}
+
+func (sp *tSpool) Qp() int {
+	return os.Getpid()
+}
+
+func (sp *tSpool) Write(p []byte) (int, error) {
+	return sp.spool.Write(p)
+}
+
+/* back to the start, to be read again */
+func (sp *tSpool) rewind() error {
+	_, err := sp.spool.Seek(0, io.SeekStart)
+	return err
+}
+
+func (sp *tSpool) Abort() {
+	if sp.spool == nil {
+		return
+	}
+	sp.spool.Close()
+	os.Remove(sp.spool.Name())
+	sp.spool = nil
+}
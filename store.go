@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * A directory of small files, one per key, for state that has to be
+ * shared by every qmail-smtpd process. Keys are hashed into file names.
+ * store_update holds an exclusive lock on the file while it reads and
+ * rewrites it, so concurrent updates of one key do not get lost.
+ *
+ * store_expire removes files that have not changed in a while. It walks
+ * the whole directory, so it does so at most once a day, which is noted
+ * in the mtime of .expire.
+ */
+
+const store_sweep = 24 * time.Hour
+
+type tStore struct {
+	dir string
+}
+
+func store_path(st tStore, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:16])
+	return filepath.Join(st.dir, name[:2], name)
+}
+
+/* update gets the old data, nil if there is none, and returns the new */
+func store_update(st tStore, key string, update func([]byte) []byte) int {
+	fn := store_path(st, key)
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return -1
+	}
+	fd, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return -1
+	}
+	defer fd.Close()
+	if err := lock_ex(fd); err != nil {
+		return -1
+	}
+
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		return -1
+	}
+	if len(data) == 0 {
+		data = nil
+	}
+	data = update(data)
+
+	if err := fd.Truncate(0); err != nil {
+		return -1
+	}
+	if _, err := fd.WriteAt(data, 0); err != nil {
+		return -1
+	}
+	return 0
+}
+
+/* removes what has not been updated for maxage, if that is due */
+func store_expire(st tStore, maxage time.Duration) {
+	now := time.Now()
+	stamp := filepath.Join(st.dir, ".expire")
+	if fi, err := os.Stat(stamp); err == nil && now.Sub(fi.ModTime()) < store_sweep {
+		return
+	}
+	fd, err := os.OpenFile(stamp, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	fd.Close()
+	if os.Chtimes(stamp, now, now) != nil {
+		return
+	}
+
+	filepath.WalkDir(st.dir, func(fn string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() || fn == stamp {
+			return nil
+		}
+		if fi, err := de.Info(); err != nil || now.Sub(fi.ModTime()) < maxage {
+			return nil
+		}
+		fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+		if err != nil {
+			return nil
+		}
+		defer fd.Close()
+		if lock_ex(fd) != nil {
+			return nil
+		}
+		/* it may have been updated while we waited */
+		if fi, err := fd.Stat(); err == nil && now.Sub(fi.ModTime()) >= maxage {
+			os.Remove(fn)
+		}
+		return nil
+	})
+}
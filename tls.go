@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"time"
+)
+
+var servercert tls.Certificate
+var servercertok bool
+
+func tls_init() int {
+	cert, err := tls.LoadX509KeyPair("control/servercert.pem", "control/servercert.pem")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0
+		}
+		return -1
+	}
+	servercert = cert
+	servercertok = true
+	return 1
+}
+
+func (s *Session) smtp_starttls(arg string) {
+	if !servercertok || s.ssl != nil {
+		s.err_unimpl()
+		return
+	}
+	if arg != "" {
+		s.reply_out(reply(501, "5.5.4", "no parameters allowed"))
+		return
+	}
+	s.bdat_abort()
+	s.reply_out(reply(220, "2.0.0", "ready for tls"))
+	s.flush()
+
+	conn := tls.Server(s.conn, &tls.Config{Certificates: []tls.Certificate{servercert}})
+	s.conn.SetDeadline(time.Now().Add(timeout))
+	if err := conn.Handshake(); err != nil {
+		s.die_read()
+	}
+	s.ssl = conn
+
+	/* anything pipelined before the handshake is dropped here (rfc 3207) */
+	s.ssin.Reset(safeReader{s})
+	s.ssout.Reset(safeWriter{s})
+
+	/* forget everything we were told in plaintext */
+	s.queue_reset()
+	s.seenmail = false
+	s.rcptto = s.rcptto[:0]
+	s.rcptdsn = s.rcptdsn[:0]
+	s.fakehelo = ""
+	s.dohelo(s.remotehost)
+	s.authd = false
+	s.relayclient = s.connrelayclient
+	s.relayclientok = s.connrelayclientok
+	s.remoteinfo = s.connremoteinfo
+}
+
+func (s *Session) tls_protocol() string {
+	st := s.ssl.ConnectionState()
+	return "(" + tls.VersionName(st.Version) + " " + tls.CipherSuiteName(st.CipherSuite) + " encrypted) SMTP"
+}
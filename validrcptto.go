@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"qmail-smtpd/cdb"
+)
+
+/*
+ * control/validrcptto lists the addresses that exist, one per line:
+ *
+ *   joe@example.com
+ *   @example.net
+ *
+ * @domain takes everything at that domain. A domain with at least one
+ * line is checked, and RCPTs to addresses it does not list get a 550;
+ * mail to other domains is taken as before. control/validrcptto.cdb, made
+ * by qmail-newvrt, may be used instead of or together with the flat file.
+ * Only RCPTs that are not relayed are checked.
+ */
+
+var vrtok bool
+var mapvrt = tConstmap{}
+var mapvrtdomains = tConstmap{}
+var fdvrt *os.File
+
+func vrt_domain(addr string) string {
+	j := strings.LastIndexByte(addr, '@')
+	return addr[j+1:]
+}
+
+/* lowercased, with the domain in A-labels */
+func vrt_norm(addr string) string {
+	j := strings.LastIndexByte(addr, '@')
+	if j == -1 {
+		return strings.ToLower(addr)
+	}
+	return strings.ToLower(addr[:j+1]) + domain_toascii(addr[j+1:])
+}
+
+func vrt_init() int {
+	ss, r := control_readfile("control/validrcptto", false)
+	if r == -1 {
+		return -1
+	}
+	if r == 1 {
+		for i := range ss {
+			ss[i] = vrt_norm(ss[i])
+			if strings.IndexByte(ss[i], '@') != -1 {
+				constmap_init(mapvrtdomains, []string{vrt_domain(ss[i])})
+			}
+		}
+		constmap_init(mapvrt, ss)
+		vrtok = true
+	}
+
+	fd, err := os.Open("control/validrcptto.cdb")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return -1
+		}
+	} else {
+		fdvrt = fd /* kept open for good, shared by all sessions */
+		vrtok = true
+	}
+	return 0
+}
+
+/* 1 if found, 0 if not, -1 if the cdb cannot be read */
+func vrt_lookup(key string) int {
+	if constmap(mapvrt, key) {
+		return 1
+	}
+	if fdvrt != nil {
+		_, r := cdb.Seek(fdvrt, []byte(key))
+		return r
+	}
+	return 0
+}
+
+/* 1 if addr may be delivered here, 0 if not, -1 on error */
+func vrt_check(addr string) int {
+	if !vrtok {
+		return 1
+	}
+	if strings.IndexByte(addr, '@') == -1 {
+		return 1 /* presumably envnoathost is acceptable */
+	}
+	addr = vrt_norm(addr)
+	domain := vrt_domain(addr)
+
+	for _, key := range []string{addr, "@" + domain} {
+		if r := vrt_lookup(key); r != 0 {
+			return r
+		}
+	}
+
+	/* qmail-newvrt writes every domain it saw as a key of its own */
+	if constmap(mapvrtdomains, domain) {
+		return 0
+	}
+	if fdvrt != nil {
+		switch _, r := cdb.Seek(fdvrt, []byte(domain)); r {
+		case 1:
+			return 0
+		case -1:
+			return -1
+		}
+	}
+	return 1
+}
+
+func (s *Session) err_vrt() {
+	s.reply_out(reply(550, "5.1.1", "sorry, no mailbox here by that name"))
+}
+
+func (s *Session) addrvalid() bool {
+	r := vrt_check(s.addr)
+	if r == -1 {
+		s.die_control()
+	}
+	return r != 0
+}